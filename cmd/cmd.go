@@ -24,7 +24,8 @@ responsible for lxc instance lifecycle management as well as the network proxy`,
 	Commands: []*cli.Command{
 		launchCommand,
 		manageCommand,
-		loadCommand,
+		resizeCommand,
+		imageCommand,
 	},
 	Flags: []cli.Flag{
 		&cli.BoolFlag{
@@ -0,0 +1,542 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"lxc-launcher/image"
+	"lxc-launcher/log"
+	"lxc-launcher/lxd"
+
+	"github.com/lxc/lxd/shared/api"
+	"github.com/lxc/lxd/shared/units"
+	"github.com/urfave/cli/v2"
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+)
+
+const (
+	Force           = "force"
+	RollbackVersion = "rollback-version"
+	StatusAddresses = "status-addresses"
+	SyncStatus      = "sync-status"
+	// length of digest and fingerprint displayed in image status
+	SHORT_ID_LENGTH = 12
+)
+
+const (
+	// exit codes of image commands for scripting
+	ExitCodeFailure  = 1
+	ExitCodeUsage    = 2
+	ExitCodeNotFound = 3
+)
+
+var imageCommand = &cli.Command{
+	Name:    "image",
+	Aliases: []string{"i"},
+	Usage:   "Manage lxd images synced by launcher: launcher image <command>",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "pull",
+			Usage:  "Pull image from registry and load it into lxd: launcher image pull <image-reference> <image sync folder>",
+			Flags:  append(lxdFlags(), pullFlags()...),
+			Before: validateImageArgs(2, "require image reference and image sync folder"),
+			Action: imagePull,
+		},
+		{
+			Name:   "import",
+			Usage:  "Import lxd image from directory, bundle tarball of lxd image files or unified image tarball without registry: launcher image import <dir|tarball>",
+			Flags:  append(lxdFlags(), loadFlags()...),
+			Before: validateImageArgs(1, "require image directory or tarball"),
+			Action: imageImport,
+		},
+		{
+			Name:   "list",
+			Usage:  "List lxd images: launcher image list",
+			Flags:  lxdFlags(),
+			Before: validateImageArgs(0, ""),
+			Action: imageList,
+		},
+		{
+			Name:  "delete",
+			Usage: "Delete lxd images: launcher image delete <alias|fingerprint>...",
+			Flags: append(lxdFlags(),
+				&cli.BoolFlag{
+					Name:    Force,
+					Aliases: []string{"f"},
+					Value:   false,
+					Usage:   "delete images even if instances are created from them",
+					EnvVars: []string{GenerateEnvFlags(Force)},
+				},
+			),
+			Before: validateImageArgs(1, "require image alias or fingerprint"),
+			Action: imageDelete,
+		},
+		{
+			Name:   "inspect",
+			Usage:  "Show lxd image and its versions in json: launcher image inspect <alias|fingerprint>",
+			Flags:  lxdFlags(),
+			Before: validateImageArgs(1, "require image alias or fingerprint"),
+			Action: imageInspect,
+		},
+		{
+			Name:  "rollback",
+			Usage: "Point image alias to an earlier version: launcher image rollback <alias>",
+			Flags: append(lxdFlags(),
+				&cli.StringFlag{
+					Name:    RollbackVersion,
+					Aliases: []string{"rv"},
+					Value:   "",
+					Usage:   "version (digest short, versioned alias or fingerprint) rolled back to, the previous one when empty",
+					EnvVars: []string{GenerateEnvFlags(RollbackVersion)},
+				},
+			),
+			Before: validateImageArgs(1, "require image alias"),
+			Action: rollbackImage,
+		},
+		{
+			Name:  "status",
+			Usage: "Show sync state of images: launcher image status [image sync folder]",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:    StatusAddresses,
+					Aliases: []string{"sa"},
+					Usage: "status addresses (<host>:<port>) of manage command on nodes, state is read from " +
+						"image sync folder when not specified",
+					EnvVars: []string{GenerateEnvFlags(StatusAddresses)},
+				},
+				&cli.StringFlag{
+					Name:    SyncStatus,
+					Aliases: []string{"ss"},
+					Value:   "",
+					Usage:   "only show images in sync status, pending, synced or failed",
+					EnvVars: []string{GenerateEnvFlags(SyncStatus)},
+				},
+			},
+			Action: imageStatus,
+		},
+	},
+}
+
+// lxdFlags are the flags for connecting lxd server used by image commands
+func lxdFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    LXDSocket,
+			Aliases: []string{"l"},
+			Value:   "",
+			Usage:   "lxd socket file for communicating",
+			EnvVars: []string{GenerateEnvFlags(LXDSocket)},
+		},
+		&cli.StringFlag{
+			Name:    LXDServerAddress,
+			Aliases: []string{"s"},
+			Value:   "",
+			Usage:   "lxd server address for communication, only work when lxd socket not specified",
+			EnvVars: []string{GenerateEnvFlags(LXDServerAddress)},
+		},
+		&cli.StringFlag{
+			Name:    ClientKeyPath,
+			Aliases: []string{"k"},
+			Value:   "",
+			Usage:   "key path for lxd client authentication, only work when lxd socket not specified",
+			EnvVars: []string{GenerateEnvFlags(ClientKeyPath)},
+		},
+		&cli.StringFlag{
+			Name:    ClientCertPath,
+			Aliases: []string{"c"},
+			Value:   "",
+			Usage:   "cert path for lxd client authentication, only work when lxd socket not specified",
+			EnvVars: []string{GenerateEnvFlags(ClientCertPath)},
+		},
+	}
+}
+
+// loadFlags are the flags of images loaded into lxd
+func loadFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    ImageAlias,
+			Aliases: []string{"im"},
+			Value:   "",
+			Usage:   "lxd alias of image, inferred from image name when empty",
+			EnvVars: []string{GenerateEnvFlags(ImageAlias)},
+		},
+		&cli.StringFlag{
+			Name:    InstanceType,
+			Aliases: []string{"t"},
+			Value:   "",
+			Usage:   "instance type of image, container or virtual-machine, inferred from image files when empty",
+			EnvVars: []string{GenerateEnvFlags(InstanceType)},
+		},
+	}
+}
+
+// pullFlags are the flags of pulling images from registry
+func pullFlags() []cli.Flag {
+	return append(loadFlags(),
+		&cli.StringFlag{
+			Name:    RegistryUser,
+			Aliases: []string{"u"},
+			Value:   "",
+			Usage:   "docker registry user",
+			EnvVars: []string{GenerateEnvFlags(RegistryUser)},
+		},
+		&cli.StringFlag{
+			Name:    RegistryPassword,
+			Aliases: []string{"p"},
+			Value:   "",
+			Usage:   "docker registry password",
+			EnvVars: []string{GenerateEnvFlags(RegistryPassword)},
+		},
+		&cli.StringFlag{
+			Name:    RegistryAuthFile,
+			Aliases: []string{"raf"},
+			Value:   "",
+			Usage:   "docker config.json or dockerconfigjson secret with per registry credentials and credential helpers",
+			EnvVars: []string{GenerateEnvFlags(RegistryAuthFile)},
+		},
+		&cli.StringSliceFlag{
+			Name:    InsecureRegistries,
+			Aliases: []string{"ir"},
+			Usage:   "registries accessed via plain http, in the format of <host>[:<port>]",
+			EnvVars: []string{GenerateEnvFlags(InsecureRegistries)},
+		},
+		&cli.StringSliceFlag{
+			Name:    RegistryMirrors,
+			Aliases: []string{"rm"},
+			Usage:   "registry mirrors tried in order before upstream, in the format of <registry-host>=<mirror>",
+			EnvVars: []string{GenerateEnvFlags(RegistryMirrors)},
+		},
+		&cli.StringFlag{
+			Name:    RegistryProxy,
+			Aliases: []string{"rp"},
+			Value:   "",
+			Usage:   "http(s) proxy for registry requests, proxy environments are used when empty",
+			EnvVars: []string{GenerateEnvFlags(RegistryProxy)},
+		},
+		&cli.StringFlag{
+			Name:    RegistryCABundle,
+			Aliases: []string{"rca"},
+			Value:   "",
+			Usage:   "PEM bundle of additional CA certificates trusted when accessing registries",
+			EnvVars: []string{GenerateEnvFlags(RegistryCABundle)},
+		},
+		&cli.StringFlag{
+			Name:    DownloadRateLimit,
+			Aliases: []string{"drl"},
+			Value:   "",
+			Usage:   "bandwidth cap shared by all image downloads per second, e.g. 20Mi, unlimited when empty",
+			EnvVars: []string{GenerateEnvFlags(DownloadRateLimit)},
+		},
+		&cli.Int64Flag{
+			Name:    ImageRetain,
+			Aliases: []string{"ire"},
+			Value:   image.DEFAULT_IMAGE_RETAIN,
+			Usage:   "versions retained for rollback of images declared with keepPrevious, including the current one",
+			EnvVars: []string{GenerateEnvFlags(ImageRetain)},
+		},
+		&cli.StringFlag{
+			Name:    ConvertMode,
+			Aliases: []string{"cm"},
+			Value:   image.CONVERT_MODE_AUTO,
+			Usage:   "convert ordinary OCI images into lxd images, auto(images without lxd.tar.xz), always or never",
+			EnvVars: []string{GenerateEnvFlags(ConvertMode)},
+		},
+		&cli.StringFlag{
+			Name:    ImageFormat,
+			Aliases: []string{"if"},
+			Value:   image.IMAGE_FORMAT_UNIFIED,
+			Usage:   "format of converted lxd images, unified or split(requires mksquashfs)",
+			EnvVars: []string{GenerateEnvFlags(ImageFormat)},
+		},
+		&cli.StringSliceFlag{
+			Name:    PublicKeys,
+			Aliases: []string{"pk"},
+			Usage:   "PEM public key files to verify cosign signatures of images, images failed are not loaded",
+			EnvVars: []string{GenerateEnvFlags(PublicKeys)},
+		},
+	)
+}
+
+// validateImageArgs checks arguments of image command and connects lxd server
+func validateImageArgs(count int, usage string) cli.BeforeFunc {
+	return func(c *cli.Context) error {
+		var err error
+		if c.Args().Len() < count {
+			return cli.Exit(usage, ExitCodeUsage)
+		}
+		if (len(c.String(LXDSocket)) == 0 || !fileutil.Exist(c.String(LXDSocket))) && len(c.String(LXDServerAddress)) == 0 {
+			return cli.Exit(fmt.Sprintf("lxd socket file %s not existed and lxd server address %s not specified",
+				c.String(LXDSocket), c.String(LXDServerAddress)), ExitCodeUsage)
+		}
+		serverAddress := c.String(LXDServerAddress)
+		if net.ParseIP(c.String(LXDServerAddress)) != nil {
+			serverAddress = fmt.Sprintf("https://%s:8443", c.String(LXDServerAddress))
+		}
+		if lxdClient, err = lxd.NewClient(c.String(LXDSocket), serverAddress, c.String(ClientKeyPath),
+			c.String(ClientCertPath), log.Logger); err != nil {
+			return cli.Exit(err.Error(), ExitCodeFailure)
+		}
+		return nil
+	}
+}
+
+func imagePull(c *cli.Context) error {
+	reference, folder := c.Args().Get(0), c.Args().Get(1)
+	if !fileutil.Exist(folder) {
+		return cli.Exit(fmt.Sprintf("image sync folder %s not existed", folder), ExitCodeUsage)
+	}
+	detail := image.ImageDetail{
+		Name:  reference,
+		Alias: c.String(ImageAlias),
+		Type:  c.String(InstanceType),
+		// versions are only retained when asked
+		KeepPrevious: c.IsSet(ImageRetain),
+	}
+	if err := detail.Validate(); err != nil {
+		return cli.Exit(err.Error(), ExitCodeUsage)
+	}
+	options, err := registryOptions(c)
+	if err != nil {
+		return cli.Exit(err.Error(), ExitCodeUsage)
+	}
+	handler, err := image.NewImageHandler(options, convertOptions(c), image.GCOptions{}, c.StringSlice(PublicKeys),
+		nil, folder, 1, 0, c.Int64(ImageRetain), lxdClient, log.Logger)
+	if err != nil {
+		return cli.Exit(err.Error(), ExitCodeUsage)
+	}
+	puller, err := handler.LoadImage(context.Background(), detail)
+	if err != nil {
+		log.Logger.Error(fmt.Sprintf("failed to pull image %s, %s", reference, err))
+		return cli.Exit(err.Error(), ExitCodeFailure)
+	}
+	fmt.Printf("image %s loaded as %s(%s)\n", reference, puller.Alias(), puller.Fingerprint())
+	return nil
+}
+
+func imageImport(c *cli.Context) error {
+	path := c.Args().First()
+	if !fileutil.Exist(path) {
+		return cli.Exit(fmt.Sprintf("image %s not existed", path), ExitCodeNotFound)
+	}
+	fingerprint, err := image.ImportLocalImage(context.Background(), path, c.String(ImageAlias), c.String(InstanceType), lxdClient,
+		log.Logger)
+	if err != nil {
+		log.Logger.Error(fmt.Sprintf("failed to import image %s, %s", path, err))
+		return cli.Exit(err.Error(), ExitCodeFailure)
+	}
+	fmt.Printf("image %s imported as %s\n", path, fingerprint)
+	return nil
+}
+
+func imageList(c *cli.Context) error {
+	images, err := lxdClient.GetImages()
+	if err != nil {
+		return cli.Exit(err.Error(), ExitCodeFailure)
+	}
+	inUse, err := lxdClient.GetBaseImages()
+	if err != nil {
+		return cli.Exit(err.Error(), ExitCodeFailure)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].UploadedAt.After(images[j].UploadedAt)
+	})
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "FINGERPRINT\tALIASES\tTYPE\tSIZE\tUPLOADED\tIN USE")
+	for _, i := range images {
+		var aliases []string
+		for _, alias := range i.Aliases {
+			aliases = append(aliases, alias.Name)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%t\n", shortID(i.Fingerprint), strings.Join(aliases, ","), i.Type,
+			units.GetByteSizeString(i.Size, 1), i.UploadedAt.Format(time.RFC3339), inUse[i.Fingerprint])
+	}
+	if err = writer.Flush(); err != nil {
+		return cli.Exit(err.Error(), ExitCodeFailure)
+	}
+	return nil
+}
+
+func imageDelete(c *cli.Context) error {
+	inUse, err := lxdClient.GetBaseImages()
+	if err != nil {
+		return cli.Exit(err.Error(), ExitCodeFailure)
+	}
+	exitCode := 0
+	for _, name := range c.Args().Slice() {
+		i, err := image.ResolveImage(lxdClient, name)
+		if err != nil {
+			log.Logger.Error(fmt.Sprintf("unable to get image %s, %s", name, err))
+			exitCode = ExitCodeFailure
+			continue
+		}
+		if i == nil {
+			log.Logger.Error(fmt.Sprintf("image %s not found", name))
+			if exitCode == 0 {
+				exitCode = ExitCodeNotFound
+			}
+			continue
+		}
+		if inUse[i.Fingerprint] && !c.Bool(Force) {
+			log.Logger.Error(fmt.Sprintf("image %s(%s) is used by instances, skip deleting", name, i.Fingerprint))
+			exitCode = ExitCodeFailure
+			continue
+		}
+		if err = lxdClient.DeleteImageAndWait(i.Fingerprint); err != nil {
+			log.Logger.Error(fmt.Sprintf("failed to delete image %s(%s), %s", name, i.Fingerprint, err))
+			exitCode = ExitCodeFailure
+			continue
+		}
+		fmt.Printf("image %s(%s) deleted\n", name, i.Fingerprint)
+	}
+	if exitCode != 0 {
+		return cli.Exit("failed to delete images", exitCode)
+	}
+	return nil
+}
+
+// imageInspection is the output of image inspect
+type imageInspection struct {
+	Image *api.Image `json:"image"`
+	InUse bool       `json:"inUse"`
+	// versions of image alias kept for rollback
+	Versions []image.ImageVersion `json:"versions,omitempty"`
+}
+
+func imageInspect(c *cli.Context) error {
+	name := c.Args().First()
+	i, err := image.ResolveImage(lxdClient, name)
+	if err != nil {
+		return cli.Exit(err.Error(), ExitCodeFailure)
+	}
+	if i == nil {
+		return cli.Exit(fmt.Sprintf("image %s not found", name), ExitCodeNotFound)
+	}
+	inUse, err := lxdClient.GetBaseImages()
+	if err != nil {
+		return cli.Exit(err.Error(), ExitCodeFailure)
+	}
+	inspection := imageInspection{Image: i, InUse: inUse[i.Fingerprint]}
+	for _, alias := range i.Aliases {
+		if strings.Contains(alias.Name, image.VERSION_ALIAS_SEPARATOR) {
+			continue
+		}
+		versions, err := image.ListImageVersions(lxdClient, alias.Name)
+		if err != nil {
+			return cli.Exit(err.Error(), ExitCodeFailure)
+		}
+		inspection.Versions = append(inspection.Versions, versions...)
+	}
+	content, err := json.MarshalIndent(inspection, "", "  ")
+	if err != nil {
+		return cli.Exit(err.Error(), ExitCodeFailure)
+	}
+	fmt.Println(string(content))
+	return nil
+}
+
+func rollbackImage(c *cli.Context) error {
+	alias := c.Args().First()
+	version, err := image.RollbackImage(lxdClient, alias, c.String(RollbackVersion))
+	if err != nil {
+		log.Logger.Error(fmt.Sprintf("failed to roll back image %s, %s", alias, err))
+		return cli.Exit(err.Error(), ExitCodeFailure)
+	}
+	log.Logger.Info(fmt.Sprintf("image %s rolled back to version %s(%s)", alias, version.Version,
+		version.Fingerprint))
+	return nil
+}
+
+func imageStatus(c *cli.Context) error {
+	var states []*image.SyncState
+	var failed []string
+	if len(c.StringSlice(StatusAddresses)) == 0 {
+		if c.Args().Len() < 1 {
+			return cli.Exit("require image sync folder or status addresses", ExitCodeUsage)
+		}
+		state, err := image.ReadSyncState(c.Args().First())
+		if os.IsNotExist(err) {
+			return cli.Exit(fmt.Sprintf("sync state of %s not existed", c.Args().First()), ExitCodeNotFound)
+		}
+		if err != nil {
+			return cli.Exit(err.Error(), ExitCodeFailure)
+		}
+		states = append(states, state)
+	}
+	for _, address := range c.StringSlice(StatusAddresses) {
+		state, err := requestSyncState(address)
+		if err != nil {
+			log.Logger.Error(fmt.Sprintf("unable to get sync state from %s, %s", address, err))
+			failed = append(failed, address)
+			continue
+		}
+		states = append(states, state)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "NODE\tIMAGE\tALIAS\tSTATUS\tDIGEST\tFINGERPRINT\tLAST SUCCESS\tLAST FAILURE\tERROR")
+	for _, state := range states {
+		for _, s := range state.Images {
+			if len(c.String(SyncStatus)) != 0 && s.Status != c.String(SyncStatus) {
+				continue
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", state.Node, s.Name, s.Alias, s.Status,
+				shortID(s.Digest), shortID(s.Fingerprint), formatTime(s.LastSuccess), formatTime(s.LastFailure),
+				s.Error)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return cli.Exit(err.Error(), ExitCodeFailure)
+	}
+	if len(failed) != 0 {
+		return cli.Exit(fmt.Sprintf("unable to get sync state from %s", strings.Join(failed, ",")), ExitCodeFailure)
+	}
+	return nil
+}
+
+// requestSyncState gets sync state from status api of manage command
+func requestSyncState(address string) (*image.SyncState, error) {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	client := http.Client{Timeout: image.REQUEST_TIMEOUT}
+	resp, err := client.Get(strings.TrimSuffix(address, "/") + "/images/status")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("response code incorrect expected %d got %d", http.StatusOK,
+			resp.StatusCode))
+	}
+	var state image.SyncState
+	if err = json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func shortID(id string) string {
+	if index := strings.Index(id, ":"); index != -1 {
+		id = id[index+1:]
+	}
+	if len(id) > SHORT_ID_LENGTH {
+		return id[:SHORT_ID_LENGTH]
+	}
+	return id
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
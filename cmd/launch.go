@@ -1,10 +1,14 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/lxc/lxd/shared/api"
 	"github.com/urfave/cli/v2"
 	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+	"lxc-launcher/image"
 	"lxc-launcher/log"
 	"lxc-launcher/lxd"
 	"lxc-launcher/network"
@@ -12,6 +16,7 @@ import (
 	"lxc-launcher/util"
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -28,31 +33,53 @@ const (
 	InstanceContainer  = "container"
 	InstanceVM         = "virtual-machine"
 	NetworkMaxWaitTime = 120
+	// seconds between two checks of image alias when waiting for image
+	ImageWaitInterval = 5
 )
 
 const (
-	LXDSocket        = "lxd-socket"
-	LXDServerAddress = "lxd-server-address"
-	ClientKeyPath    = "client-key-path"
-	ClientCertPath   = "client-cert-path"
-	InstanceType     = "instance-type"
-	InstanceProfiles = "instance-profiles"
-	CPUResource      = "cpu-resource"
-	ProcessResource  = "process-resource"
-	MemoryResource   = "memory-resource"
-	StoragePool      = "storage-pool"
-	RootSize         = "root-size"
-	NetworkIngress   = "network-ingress"
-	NetworkEgress    = "network-egress"
-	ProxyPortPairs   = "proxy-port-pairs"
-	DeviceName       = "device-name"
-	InstanceEnvs     = "instance-envs"
-	StartCommand     = "start-command"
-	MountFiles       = "mount-files"
-	AdditionalConfig = "additional-config"
-	RemoveExisting   = "remove-existing"
-	StatusPort       = "status-port"
-	ImageAlias       = "image-alias"
+	LXDSocket          = "lxd-socket"
+	LXDServerAddress   = "lxd-server-address"
+	ClientKeyPath      = "client-key-path"
+	ClientCertPath     = "client-cert-path"
+	InstanceType       = "instance-type"
+	InstanceProfiles   = "instance-profiles"
+	CPUResource        = "cpu-resource"
+	ProcessResource    = "process-resource"
+	MemoryResource     = "memory-resource"
+	StoragePool        = "storage-pool"
+	RootSize           = "root-size"
+	NetworkIngress     = "network-ingress"
+	NetworkEgress      = "network-egress"
+	ProxyPortPairs     = "proxy-port-pairs"
+	DeviceName         = "device-name"
+	InstanceEnvs       = "instance-envs"
+	StartCommand       = "start-command"
+	MountFiles         = "mount-files"
+	AdditionalConfig   = "additional-config"
+	RemoveExisting     = "remove-existing"
+	StatusPort         = "status-port"
+	ResizeToken        = "resize-token"
+	ImageAlias         = "image-alias"
+	ResourceSource     = "resource-source"
+	DownwardAPIPath    = "downward-api-path"
+	PodName            = "pod-name"
+	PodNamespace       = "pod-namespace"
+	ContainerName      = "container-name"
+	CPUOvercommit      = "cpu-overcommit"
+	MemoryOvercommit   = "memory-overcommit"
+	CPUPinning         = "cpu-pinning"
+	MemorySwap         = "memory-swap"
+	MemoryEnforce      = "memory-enforce"
+	Hugepages          = "hugepages"
+	DiskPriority       = "disk-priority"
+	DiskRead           = "disk-read"
+	DiskWrite          = "disk-write"
+	DryRun             = "dry-run"
+	ImageWaitTimeout   = "image-wait-timeout"
+	ImageStatusAddress = "image-status-address"
+	ImageReference     = "image-reference"
+	ImageFolder        = "image-folder"
 )
 
 var launchCommand = &cli.Command{
@@ -105,7 +132,7 @@ var launchCommand = &cli.Command{
 			Name:    CPUResource,
 			Aliases: []string{"rc"},
 			Value:   "",
-			Usage:   "CPU limitation of lxc instance",
+			Usage:   "CPU limitation of lxc instance, in cores (2, 0.5), millicores (500m) or percentage (50%)",
 			EnvVars: []string{GenerateEnvFlags(CPUResource)},
 		},
 		&cli.StringFlag{
@@ -119,7 +146,7 @@ var launchCommand = &cli.Command{
 			Name:    MemoryResource,
 			Aliases: []string{"rm"},
 			Value:   "",
-			Usage:   "Memory limitation of lxc instance",
+			Usage:   "Memory limitation of lxc instance, in quantity (512Mi, 2G, 1GiB) or percentage (50%)",
 			EnvVars: []string{GenerateEnvFlags(MemoryResource)},
 		},
 		&cli.StringFlag{
@@ -135,21 +162,21 @@ var launchCommand = &cli.Command{
 			Aliases:  []string{"rd"},
 			Required: true,
 			Value:    "",
-			Usage:    "Root size for lxc instance",
+			Usage:    "Root size for lxc instance, in quantity (10Gi, 10G, 10GiB)",
 			EnvVars:  []string{GenerateEnvFlags(RootSize)},
 		},
 		&cli.StringFlag{
 			Name:    NetworkIngress,
 			Aliases: []string{"ri"},
 			Value:   "",
-			Usage:   "Ingress limit for lxc instance",
+			Usage:   "Ingress limit for lxc instance, in bit/s quantity (100M, 100Mbit, 1Gibit)",
 			EnvVars: []string{GenerateEnvFlags(NetworkIngress)},
 		},
 		&cli.StringFlag{
 			Name:    NetworkEgress,
 			Aliases: []string{"re"},
 			Value:   "",
-			Usage:   "Egress limit for lxc instance",
+			Usage:   "Egress limit for lxc instance, in bit/s quantity (100M, 100Mbit, 1Gibit)",
 			EnvVars: []string{GenerateEnvFlags(NetworkEgress)},
 		},
 		&cli.StringSliceFlag{
@@ -201,9 +228,17 @@ var launchCommand = &cli.Command{
 			Name:    StatusPort,
 			Aliases: []string{"stp"},
 			Value:   8082,
-			Usage:   "health server port",
+			Usage:   "health server port, launcher keeps serving health and resize on it even without proxies if specified",
 			EnvVars: []string{GenerateEnvFlags(StatusPort)},
 		},
+		&cli.StringFlag{
+			Name:    ResizeToken,
+			Aliases: []string{"rt"},
+			Value:   "",
+			Usage: "bearer token required by resize endpoint on status server, only local requests allowed if empty. " +
+				"launcher keeps serving status server even without proxies if specified",
+			EnvVars: []string{GenerateEnvFlags(ResizeToken)},
+		},
 		&cli.StringFlag{
 			Name:     ImageAlias,
 			Aliases:  []string{"im"},
@@ -212,6 +247,164 @@ var launchCommand = &cli.Command{
 			Usage:    "image alias for lxd instance",
 			EnvVars:  []string{GenerateEnvFlags(ImageAlias)},
 		},
+		&cli.StringFlag{
+			Name:    ResourceSource,
+			Aliases: []string{"rs"},
+			Value:   "",
+			Usage:   "derive cpu and memory limitation from launcher container, downward-api or kubernetes, explicit cpu and memory resource take precedence",
+			EnvVars: []string{GenerateEnvFlags(ResourceSource)},
+		},
+		&cli.StringFlag{
+			Name:    DownwardAPIPath,
+			Aliases: []string{"dap"},
+			Value:   "/etc/podinfo",
+			Usage:   "folder of downward api volume which contains cpu_limit (divisor 1m) and memory_limit (divisor 1)",
+			EnvVars: []string{GenerateEnvFlags(DownwardAPIPath)},
+		},
+		&cli.StringFlag{
+			Name:    PodName,
+			Aliases: []string{"pn"},
+			Value:   "",
+			Usage:   "name of launcher pod, used when resource source is kubernetes",
+			EnvVars: []string{GenerateEnvFlags(PodName), "POD_NAME"},
+		},
+		&cli.StringFlag{
+			Name:    PodNamespace,
+			Aliases: []string{"pns"},
+			Value:   "",
+			Usage:   "namespace of launcher pod, used when resource source is kubernetes",
+			EnvVars: []string{GenerateEnvFlags(PodNamespace), "POD_NAMESPACE"},
+		},
+		&cli.StringFlag{
+			Name:    ContainerName,
+			Aliases: []string{"cn"},
+			Value:   "",
+			Usage:   "name of launcher container, the first container of pod will be used if empty",
+			EnvVars: []string{GenerateEnvFlags(ContainerName)},
+		},
+		&cli.Float64Flag{
+			Name:    CPUOvercommit,
+			Aliases: []string{"co"},
+			Value:   1.0,
+			Usage:   "ratio applied on cpu limitation derived from launcher container",
+			EnvVars: []string{GenerateEnvFlags(CPUOvercommit)},
+		},
+		&cli.Float64Flag{
+			Name:    MemoryOvercommit,
+			Aliases: []string{"mo"},
+			Value:   1.0,
+			Usage:   "ratio applied on memory limitation derived from launcher container",
+			EnvVars: []string{GenerateEnvFlags(MemoryOvercommit)},
+		},
+		&cli.StringFlag{
+			Name:    CPUPinning,
+			Aliases: []string{"cpn"},
+			Value:   "",
+			Usage:   "CPU set the lxc instance pinned to, for example: 0-3,5",
+			EnvVars: []string{GenerateEnvFlags(CPUPinning)},
+		},
+		&cli.BoolFlag{
+			Name:    MemorySwap,
+			Aliases: []string{"ms"},
+			Usage:   "Whether to allow swap of lxc container, lxd default is used if not specified",
+			EnvVars: []string{GenerateEnvFlags(MemorySwap)},
+		},
+		&cli.StringFlag{
+			Name:    MemoryEnforce,
+			Aliases: []string{"me"},
+			Value:   "",
+			Usage:   "Memory enforcement of lxc container, hard or soft",
+			EnvVars: []string{GenerateEnvFlags(MemoryEnforce)},
+		},
+		&cli.StringSliceFlag{
+			Name:    Hugepages,
+			Aliases: []string{"hp"},
+			Usage:   "Hugepages limitation of lxc container, in the format of <page-size>=<limit>, for example: 2MB=1Gi",
+			EnvVars: []string{GenerateEnvFlags(Hugepages)},
+		},
+		&cli.StringFlag{
+			Name:    DiskPriority,
+			Aliases: []string{"dp"},
+			Value:   "",
+			Usage:   "Disk I/O priority of lxc instance, between 0 and 10",
+			EnvVars: []string{GenerateEnvFlags(DiskPriority)},
+		},
+		&cli.StringFlag{
+			Name:    DiskRead,
+			Aliases: []string{"dr"},
+			Value:   "",
+			Usage:   "Root disk read limit of lxc instance, in iops (100iops) or bytes/s (10Mi, 10MB)",
+			EnvVars: []string{GenerateEnvFlags(DiskRead)},
+		},
+		&cli.StringFlag{
+			Name:    DiskWrite,
+			Aliases: []string{"dw"},
+			Value:   "",
+			Usage:   "Root disk write limit of lxc instance, in iops (100iops) or bytes/s (10Mi, 10MB)",
+			EnvVars: []string{GenerateEnvFlags(DiskWrite)},
+		},
+		&cli.BoolFlag{
+			Name:    DryRun,
+			Aliases: []string{"dry"},
+			Value:   false,
+			Usage:   "Validate and print instance payloads as well as the diff against existing instance without changing anything",
+			EnvVars: []string{GenerateEnvFlags(DryRun)},
+		},
+		&cli.DurationFlag{
+			Name:    ImageWaitTimeout,
+			Aliases: []string{"iwt"},
+			Value:   0,
+			Usage:   "how long to wait for image alias synced by manage command or pulled on demand before failing, 0 means failing immediately when not pulling",
+			EnvVars: []string{GenerateEnvFlags(ImageWaitTimeout)},
+		},
+		&cli.StringFlag{
+			Name:    ImageStatusAddress,
+			Aliases: []string{"isa"},
+			Value:   "",
+			Usage:   "status address (<host>:<port>) of manage command on the same node, used to report sync state of image when waiting",
+			EnvVars: []string{GenerateEnvFlags(ImageStatusAddress)},
+		},
+		&cli.StringFlag{
+			Name:    ImageReference,
+			Aliases: []string{"iref"},
+			Value:   "",
+			Usage:   "registry image reference pulled on demand when image alias not found, image alias is waited for when empty",
+			EnvVars: []string{GenerateEnvFlags(ImageReference)},
+		},
+		&cli.StringFlag{
+			Name:    ImageFolder,
+			Aliases: []string{"if"},
+			Value:   "",
+			Usage:   "image sync folder of manage command on the same node, required when pulling image on demand",
+			EnvVars: []string{GenerateEnvFlags(ImageFolder)},
+		},
+		&cli.StringFlag{
+			Name:    RegistryUser,
+			Aliases: []string{"ru"},
+			Value:   "",
+			Usage:   "registry user used when pulling image on demand",
+			EnvVars: []string{GenerateEnvFlags(RegistryUser)},
+		},
+		&cli.StringFlag{
+			Name:    RegistryPassword,
+			Aliases: []string{"rpw"},
+			Value:   "",
+			Usage:   "registry password used when pulling image on demand",
+			EnvVars: []string{GenerateEnvFlags(RegistryPassword)},
+		},
+		&cli.StringFlag{
+			Name:    RegistryAuthFile,
+			Aliases: []string{"raf"},
+			Value:   "",
+			Usage:   "docker config file which contains auths of registries, used when pulling image on demand",
+			EnvVars: []string{GenerateEnvFlags(RegistryAuthFile)},
+		},
+		&cli.StringSliceFlag{
+			Name:    InsecureRegistries,
+			Aliases: []string{"ir"},
+			Usage:   "registries accessed via plain http, in the format of <host>[:<port>]",
+			EnvVars: []string{GenerateEnvFlags(InsecureRegistries)},
+		},
 	},
 	Before: validateLaunch,
 	Action: handleLaunch,
@@ -241,21 +434,46 @@ func validateLaunch(c *cli.Context) error {
 		return err
 	}
 
+	cpuResource, memoryResource, err := resolveResource(c)
+	if err != nil {
+		return err
+	}
 	log.Logger.Info(fmt.Sprintf("start to validate resource limit on instance %s", instName))
-	if err = lxdClient.ValidateResourceLimit(
-		c.String(NetworkEgress), c.String(NetworkIngress), c.String(RootSize),
-		c.String(StoragePool), c.String(MemoryResource), c.String(CPUResource), c.StringSlice(AdditionalConfig),
-		c.String(DeviceName), c.String(ProcessResource), c.String(InstanceType)); err != nil {
+	spec := lxd.ResourceSpec{
+		InstanceType:     c.String(InstanceType),
+		DeviceName:       c.String(DeviceName),
+		StoragePool:      c.String(StoragePool),
+		RootSize:         c.String(RootSize),
+		DiskRead:         c.String(DiskRead),
+		DiskWrite:        c.String(DiskWrite),
+		DiskPriority:     c.String(DiskPriority),
+		Ingress:          c.String(NetworkIngress),
+		Egress:           c.String(NetworkEgress),
+		CPU:              cpuResource,
+		CPUPinning:       c.String(CPUPinning),
+		Memory:           memoryResource,
+		MemoryEnforce:    c.String(MemoryEnforce),
+		Hugepages:        c.StringSlice(Hugepages),
+		Processes:        c.String(ProcessResource),
+		AdditionalConfig: c.StringSlice(AdditionalConfig),
+	}
+	if c.IsSet(MemorySwap) {
+		spec.MemorySwap = strconv.FormatBool(c.Bool(MemorySwap))
+	}
+	if err = lxdClient.ValidateResourceLimit(spec); err != nil {
 		return err
 	}
 	log.Logger.Info(fmt.Sprintf("start to check image %s existence", lxcImage))
-	imageExists, err := lxdClient.CheckImageByAlias(lxcImage)
+	if c.Bool(DryRun) {
+		err = reportImage(c)
+	} else if len(c.String(ImageReference)) != 0 {
+		err = pullImage(c)
+	} else {
+		err = waitForImage(lxcImage, c.Duration(ImageWaitTimeout), c.String(ImageStatusAddress))
+	}
 	if err != nil {
 		return err
 	}
-	if !imageExists {
-		return errors.New(fmt.Sprintf("unable to find image by alias %s", lxcImage))
-	}
 	log.Logger.Info(fmt.Sprintf("start to check instance %s existence", instName))
 	instanceExists, err := lxdClient.CheckInstanceExists(instName, c.String(InstanceType))
 	if err != nil {
@@ -271,7 +489,7 @@ func validateLaunch(c *cli.Context) error {
 		}
 		return errors.New(fmt.Sprintf("storage pool %s not existed", c.String(StoragePool)))
 	}
-	if instanceExists && c.Bool(RemoveExisting) {
+	if instanceExists && c.Bool(RemoveExisting) && !c.Bool(DryRun) {
 		log.Logger.Info(fmt.Sprintf("start to remove lxc instance %s due to existence", instName))
 		err = lxdClient.StopInstance(instName, true)
 		if err != nil {
@@ -282,6 +500,151 @@ func validateLaunch(c *cli.Context) error {
 	return nil
 }
 
+// waitForImage waits until image alias is synced by manage command on the same node, the sync state reported by
+// status api of manage command is logged while waiting when status address specified.
+func waitForImage(alias string, timeout time.Duration, statusAddress string) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		imageExists, err := lxdClient.CheckImageByAlias(alias)
+		if err != nil {
+			return err
+		}
+		if imageExists {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			if timeout == 0 {
+				return errors.New(fmt.Sprintf("unable to find image by alias %s", alias))
+			}
+			return errors.New(fmt.Sprintf("unable to find image by alias %s after waiting %s", alias, timeout))
+		}
+		if len(statusAddress) != 0 {
+			logImageState(alias, statusAddress)
+		}
+		log.Logger.Info(fmt.Sprintf("image %s not found, waiting for it to be synced", alias))
+		time.Sleep(ImageWaitInterval * time.Second)
+	}
+}
+
+// reportImage prints whether image alias exists for dry run, image is neither pulled nor waited for
+func reportImage(c *cli.Context) error {
+	imageExists, err := lxdClient.CheckImageByAlias(lxcImage)
+	if err != nil {
+		return err
+	}
+	switch {
+	case imageExists:
+		fmt.Printf("# image %s exists\n", lxcImage)
+	case len(c.String(ImageReference)) != 0:
+		fmt.Printf("# image %s not found and would be pulled from %s\n", lxcImage, c.String(ImageReference))
+	default:
+		fmt.Printf("# image %s not found and would be waited for\n", lxcImage)
+	}
+	return nil
+}
+
+// pullImage pulls image reference into lxd as image alias when alias not found, the image sync folder of manage
+// command is shared so that image is never pulled twice on the same node.
+func pullImage(c *cli.Context) error {
+	imageExists, err := lxdClient.CheckImageByAlias(lxcImage)
+	if err != nil {
+		return err
+	}
+	if imageExists {
+		return nil
+	}
+	if len(c.String(ImageFolder)) == 0 || !fileutil.Exist(c.String(ImageFolder)) {
+		return errors.New(fmt.Sprintf("image folder %s not existed, unable to pull image %s", c.String(ImageFolder),
+			c.String(ImageReference)))
+	}
+	options, err := registryOptions(c)
+	if err != nil {
+		return err
+	}
+	handler, err := image.NewImageHandler(options, image.ConvertOptions{}, image.GCOptions{}, nil, nil,
+		c.String(ImageFolder), 1, 0, 1, lxdClient, log.Logger)
+	if err != nil {
+		return err
+	}
+	detail := image.ImageDetail{
+		Name:  c.String(ImageReference),
+		Alias: lxcImage,
+		Type:  c.String(InstanceType),
+	}
+	if err = detail.Validate(); err != nil {
+		return err
+	}
+	log.Logger.Info(fmt.Sprintf("image %s not found, start to pull image %s", lxcImage, detail.Name))
+	ctx := context.Background()
+	if c.Duration(ImageWaitTimeout) != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Duration(ImageWaitTimeout))
+		defer cancel()
+	}
+	if err = handler.PullImage(ctx, detail); err != nil {
+		return errors.New(fmt.Sprintf("failed to pull image %s as %s, %s", detail.Name, lxcImage, err))
+	}
+	return nil
+}
+
+// logImageState logs sync state of image alias reported by manage command
+func logImageState(alias, statusAddress string) {
+	state, err := requestSyncState(statusAddress)
+	if err != nil {
+		log.Logger.Warn(fmt.Sprintf("unable to get sync state from %s, %s", statusAddress, err))
+		return
+	}
+	for _, s := range state.Images {
+		if s.Alias != alias {
+			continue
+		}
+		if s.Status == image.SYNC_STATUS_FAILED {
+			log.Logger.Warn(fmt.Sprintf("image %s(%s) failed to sync on node %s at %s, %s", alias, s.Name,
+				state.Node, formatTime(s.LastFailure), s.Error))
+		} else {
+			log.Logger.Info(fmt.Sprintf("image %s(%s) is %s on node %s", alias, s.Name, s.Status, state.Node))
+		}
+		return
+	}
+	log.Logger.Warn(fmt.Sprintf("image %s not declared in image list of node %s", alias, state.Node))
+}
+
+// resolveResource returns cpu and memory resource, derived from launcher container if not specified
+func resolveResource(c *cli.Context) (string, string, error) {
+	cpuResource := c.String(CPUResource)
+	memoryResource := c.String(MemoryResource)
+	if len(c.String(ResourceSource)) == 0 || (len(cpuResource) != 0 && len(memoryResource) != 0) {
+		return cpuResource, memoryResource, nil
+	}
+	if c.Float64(CPUOvercommit) <= 0 || c.Float64(MemoryOvercommit) <= 0 {
+		return "", "", errors.New("cpu and memory overcommit ratio must be greater than 0")
+	}
+	var podResource *lxd.PodResource
+	var err error
+	switch c.String(ResourceSource) {
+	case lxd.RESOURCE_SOURCE_DOWNWARD:
+		podResource, err = lxd.LoadPodResourceFromDownwardAPI(c.String(DownwardAPIPath))
+	case lxd.RESOURCE_SOURCE_KUBERNETES:
+		podResource, err = lxd.LoadPodResourceFromKubernetes(
+			c.String(PodNamespace), c.String(PodName), c.String(ContainerName))
+	default:
+		return "", "", errors.New(fmt.Sprintf("unsupported resource source %s, only support %s or %s",
+			c.String(ResourceSource), lxd.RESOURCE_SOURCE_DOWNWARD, lxd.RESOURCE_SOURCE_KUBERNETES))
+	}
+	if err != nil {
+		return "", "", errors.New(fmt.Sprintf("failed to read launcher container resource, %s", err))
+	}
+	if len(cpuResource) == 0 {
+		cpuResource = podResource.CPUResource(c.Float64(CPUOvercommit))
+	}
+	if len(memoryResource) == 0 {
+		memoryResource = podResource.MemoryResource(c.Float64(MemoryOvercommit))
+	}
+	log.Logger.Info(fmt.Sprintf("resource derived from launcher container via %s, cpu: %s, memory: %s",
+		c.String(ResourceSource), cpuResource, memoryResource))
+	return cpuResource, memoryResource, nil
+}
+
 func createInstance(c *cli.Context) error {
 	instanceExists, err := lxdClient.CheckInstanceExists(instName, c.String(InstanceType))
 	if err != nil {
@@ -331,13 +694,74 @@ func launchStatusHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// printDryRun prints the instance payloads which would be sent to lxd server
+func printDryRun(c *cli.Context) error {
+	instanceExists, err := lxdClient.CheckInstanceExists(instName, c.String(InstanceType))
+	if err != nil {
+		return err
+	}
+	// existing instance is removed and created from scratch, so that it's never compared
+	recreate := instanceExists && c.Bool(RemoveExisting)
+	instance := &api.Instance{
+		InstancePut: api.InstancePut{
+			Profiles: c.StringSlice(InstanceProfiles),
+			Config:   map[string]string{},
+		},
+		ExpandedDevices: map[string]map[string]string{},
+	}
+	if instanceExists && !recreate {
+		if instance, err = lxdClient.GetInstance(instName); err != nil {
+			return err
+		}
+	}
+	currentConfig := util.CopyConfigs(instance.Config)
+	currentDevices := util.CopyDeviceConfigs(instance.ExpandedDevices)
+	if recreate {
+		fmt.Printf("# instance %s exists and will be recreated\n", instName)
+	}
+	if !instanceExists || recreate {
+		post := lxdClient.BuildInstancesPost(lxcImage, instName, c.StringSlice(InstanceProfiles), c.String(InstanceType))
+		content, err := json.MarshalIndent(post, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("# api.InstancesPost for instance %s\n%s\n", instName, content)
+	}
+	put := lxdClient.BuildInstancePut(instance, c.StringSlice(InstanceEnvs))
+	content, err := json.MarshalIndent(put, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("# api.InstancePut for instance %s\n%s\n", instName, content)
+	if instanceExists && !recreate {
+		fmt.Printf("# diff against existing instance %s (expanded devices)\n", instName)
+		diff := append(util.DiffConfigs("config.", currentConfig, put.Config),
+			util.DiffDeviceConfigs(currentDevices, put.Devices)...)
+		for _, d := range diff {
+			fmt.Println(d)
+		}
+		if len(diff) == 0 {
+			fmt.Println("no changes")
+		}
+	}
+	return nil
+}
+
 func handleLaunch(c *cli.Context) error {
 	var err error
 	var ipaddress string
+	if c.Bool(DryRun) {
+		return printDryRun(c)
+	}
 	// 1. create and wait instance ready
 	if err = createInstance(c); err != nil {
 		return err
 	}
+	// launcher without proxies quits after launching unless status server is requested explicitly
+	serveStatus := c.IsSet(StatusPort) || c.IsSet(ResizeToken)
+	if len(c.StringSlice(ProxyPortPairs)) == 0 && !serveStatus {
+		return nil
+	}
 	//start proxy if needed
 	if len(c.StringSlice(ProxyPortPairs)) != 0 {
 		ipaddress, err = lxdClient.WaitInstanceNetworkReady(instName, c.String(DeviceName), NetworkMaxWaitTime)
@@ -351,19 +775,28 @@ func handleLaunch(c *cli.Context) error {
 			CleanupLaunch()
 			return err
 		}
-		//watch instance status
-		prober, err = task.NewProber(instName, lxdClient, 5, log.Logger)
-		if err != nil {
-			CleanupLaunch()
-			return err
-		}
-		// start health status
-		go prober.StartLoop()
-		go util.ServerHealth(launchStatusHandler, c.Int64(StatusPort))
-		//watch os signal
-		util.ListenSignals(CleanupLaunch)
-		//start proxying
-		networkProxy.StartLoop()
 	}
+	//watch instance status
+	prober, err = task.NewProber(instName, lxdClient, 5, log.Logger)
+	if err != nil {
+		CleanupLaunch()
+		return err
+	}
+	// start health status
+	go prober.StartLoop()
+	handlers := util.StatusHandlers{
+		"/healthz": launchStatusHandler,
+		"/resize":  resizeStatusHandler(c.String(DeviceName), c.String(ResizeToken)),
+	}
+	//watch os signal
+	util.ListenSignals(CleanupLaunch)
+	if networkProxy == nil {
+		// status server keeps launcher running so that instance can still be probed and resized
+		util.ServerStatus(handlers, c.Int64(StatusPort))
+		return nil
+	}
+	go util.ServerStatus(handlers, c.Int64(StatusPort))
+	//start proxying
+	networkProxy.StartLoop()
 	return nil
 }
@@ -10,6 +10,7 @@ import (
 	"lxc-launcher/lxd"
 	"lxc-launcher/util"
 	"net"
+	"net/http"
 	"time"
 )
 
@@ -19,12 +20,27 @@ var (
 )
 
 const (
-	ImageWorker      = "image-worker"
-	SyncInterval     = "sync-interval"
-	MetaEndpoint     = "meta-endpoint"
-	RegistryUser     = "registry-user"
-	RegistryPassword = "registry-password"
-	ExitWhenUnready  = "exit-when-unready"
+	ImageWorker        = "image-worker"
+	SyncInterval       = "sync-interval"
+	MetaEndpoint       = "meta-endpoint"
+	RegistryUser       = "registry-user"
+	RegistryPassword   = "registry-password"
+	ExitWhenUnready    = "exit-when-unready"
+	InsecureRegistries = "insecure-registries"
+	ConvertMode        = "convert-mode"
+	ImageFormat        = "image-format"
+	PublicKeys         = "public-keys"
+	RegistryMirrors    = "registry-mirrors"
+	RegistryProxy      = "registry-proxy"
+	RegistryCABundle   = "registry-ca-bundle"
+	RegistryAuthFile   = "registry-auth-file"
+	DownloadRateLimit  = "download-rate-limit"
+	ImageSource        = "image-source"
+	ImageRetain        = "image-retain"
+	GCMinAge           = "image-gc-min-age"
+	GCKeepLast         = "image-gc-keep-last"
+	GCHighWaterMark    = "image-gc-high-water-mark"
+	GCDryRun           = "image-gc-dry-run"
 )
 
 var manageCommand = &cli.Command{
@@ -82,11 +98,20 @@ var manageCommand = &cli.Command{
 			Usage:   "interval in seconds between two sync action",
 			EnvVars: []string{GenerateEnvFlags(SyncInterval)},
 		},
+		&cli.StringFlag{
+			Name:    ImageSource,
+			Aliases: []string{"is"},
+			Value:   image.SOURCE_HTTP,
+			Usage:   "source of images metadata, http, file, configmap or custom-resource",
+			EnvVars: []string{GenerateEnvFlags(ImageSource)},
+		},
 		&cli.StringFlag{
 			Name:    MetaEndpoint,
 			Aliases: []string{"m"},
 			Value:   "",
-			Usage:   "endpoint for images metadata",
+			Usage: "endpoint for images metadata, url for http, yaml or json file path for file, " +
+				"<namespace>/<name>[/<key>] for configmap and <group>/<version>/<resource>/<namespace>/<name> " +
+				"for custom-resource",
 			EnvVars: []string{GenerateEnvFlags(MetaEndpoint)},
 		},
 		&cli.StringFlag{
@@ -103,6 +128,108 @@ var manageCommand = &cli.Command{
 			Usage:   "docker registry password",
 			EnvVars: []string{GenerateEnvFlags(RegistryPassword)},
 		},
+		&cli.StringFlag{
+			Name:    RegistryAuthFile,
+			Aliases: []string{"raf"},
+			Value:   "",
+			Usage:   "docker config.json or dockerconfigjson secret with per registry credentials and credential helpers",
+			EnvVars: []string{GenerateEnvFlags(RegistryAuthFile)},
+		},
+		&cli.StringSliceFlag{
+			Name:    InsecureRegistries,
+			Aliases: []string{"ir"},
+			Usage:   "registries accessed via plain http, in the format of <host>[:<port>]",
+			EnvVars: []string{GenerateEnvFlags(InsecureRegistries)},
+		},
+		&cli.StringSliceFlag{
+			Name:    RegistryMirrors,
+			Aliases: []string{"rm"},
+			Usage:   "registry mirrors tried in order before upstream, in the format of <registry-host>=<mirror>",
+			EnvVars: []string{GenerateEnvFlags(RegistryMirrors)},
+		},
+		&cli.StringFlag{
+			Name:    RegistryProxy,
+			Aliases: []string{"rp"},
+			Value:   "",
+			Usage:   "http(s) proxy for registry requests, proxy environments are used when empty",
+			EnvVars: []string{GenerateEnvFlags(RegistryProxy)},
+		},
+		&cli.StringFlag{
+			Name:    RegistryCABundle,
+			Aliases: []string{"rca"},
+			Value:   "",
+			Usage:   "PEM bundle of additional CA certificates trusted when accessing registries",
+			EnvVars: []string{GenerateEnvFlags(RegistryCABundle)},
+		},
+		&cli.StringFlag{
+			Name:    DownloadRateLimit,
+			Aliases: []string{"drl"},
+			Value:   "",
+			Usage:   "bandwidth cap shared by all image downloads per second, e.g. 20Mi, unlimited when empty",
+			EnvVars: []string{GenerateEnvFlags(DownloadRateLimit)},
+		},
+		&cli.Int64Flag{
+			Name:    ImageRetain,
+			Aliases: []string{"ire"},
+			Value:   image.DEFAULT_IMAGE_RETAIN,
+			Usage:   "versions retained for rollback of images declared with keepPrevious, including the current one",
+			EnvVars: []string{GenerateEnvFlags(ImageRetain)},
+		},
+		&cli.StringFlag{
+			Name:    ConvertMode,
+			Aliases: []string{"cm"},
+			Value:   image.CONVERT_MODE_AUTO,
+			Usage:   "convert ordinary OCI images into lxd images, auto(images without lxd.tar.xz), always or never",
+			EnvVars: []string{GenerateEnvFlags(ConvertMode)},
+		},
+		&cli.StringFlag{
+			Name:    ImageFormat,
+			Aliases: []string{"if"},
+			Value:   image.IMAGE_FORMAT_UNIFIED,
+			Usage:   "format of converted lxd images, unified or split(requires mksquashfs)",
+			EnvVars: []string{GenerateEnvFlags(ImageFormat)},
+		},
+		&cli.StringSliceFlag{
+			Name:    PublicKeys,
+			Aliases: []string{"pk"},
+			Usage:   "PEM public key files to verify cosign signatures of images, images failed are not loaded",
+			EnvVars: []string{GenerateEnvFlags(PublicKeys)},
+		},
+		&cli.DurationFlag{
+			Name:    GCMinAge,
+			Aliases: []string{"gma"},
+			Value:   image.DEFAULT_GC_MIN_AGE,
+			Usage:   "unaliased lxd images uploaded or used within the duration are not collected",
+			EnvVars: []string{GenerateEnvFlags(GCMinAge)},
+		},
+		&cli.IntFlag{
+			Name:    GCKeepLast,
+			Aliases: []string{"gkl"},
+			Value:   0,
+			Usage:   "number of the newest unaliased lxd images never collected",
+			EnvVars: []string{GenerateEnvFlags(GCKeepLast)},
+		},
+		&cli.Float64Flag{
+			Name:    GCHighWaterMark,
+			Aliases: []string{"ghw"},
+			Value:   0,
+			Usage:   "usage percentage of storage pool above which unaliased lxd images are collected, 0 means always",
+			EnvVars: []string{GenerateEnvFlags(GCHighWaterMark)},
+		},
+		&cli.BoolFlag{
+			Name:    GCDryRun,
+			Aliases: []string{"gdr"},
+			Value:   false,
+			Usage:   "report unaliased lxd images which would be collected without deleting them",
+			EnvVars: []string{GenerateEnvFlags(GCDryRun)},
+		},
+		&cli.Int64Flag{
+			Name:    StatusPort,
+			Aliases: []string{"stp"},
+			Value:   0,
+			Usage:   "status server port serving image pull progress, disabled when 0",
+			EnvVars: []string{GenerateEnvFlags(StatusPort)},
+		},
 		&cli.BoolFlag{
 			Name:    ExitWhenUnready,
 			Aliases: []string{"e"},
@@ -139,17 +266,79 @@ func validateManage(c *cli.Context) error {
 	//	return nil
 	//}
 
-	imageHandler, err = image.NewImageHandler(c.String(RegistryUser), c.String(RegistryPassword), dataFolder,
-		c.String(MetaEndpoint), c.Int64(ImageWorker), c.Int64(SyncInterval), lxdClient, log.Logger)
+	options, err := registryOptions(c)
+	if err != nil {
+		return err
+	}
+	source, err := image.NewImageSource(c.String(ImageSource), c.String(MetaEndpoint), log.Logger)
+	if err != nil {
+		return err
+	}
+	imageHandler, err = image.NewImageHandler(options, convertOptions(c), gcOptions(c), c.StringSlice(PublicKeys),
+		source, dataFolder, c.Int64(ImageWorker), c.Int64(SyncInterval), c.Int64(ImageRetain), lxdClient, log.Logger)
 	if err != nil {
 		log.Logger.Error(fmt.Sprintln("image.NewImageHandler, err: ", err))
+		return err
 	}
 	return nil
 }
 
+func registryOptions(c *cli.Context) (image.RegistryOptions, error) {
+	mirrors, err := image.ParseRegistryMirrors(c.StringSlice(RegistryMirrors))
+	if err != nil {
+		return image.RegistryOptions{}, err
+	}
+	if len(c.String(RegistryAuthFile)) != 0 {
+		if _, err = image.LoadDockerConfig(c.String(RegistryAuthFile)); err != nil {
+			return image.RegistryOptions{}, err
+		}
+	}
+	var rateLimit int64
+	if len(c.String(DownloadRateLimit)) != 0 {
+		if rateLimit, err = lxd.ParseByteSize(c.String(DownloadRateLimit)); err != nil {
+			return image.RegistryOptions{}, errors.New(fmt.Sprintf("download rate limit %s incorrect, %s",
+				c.String(DownloadRateLimit), err))
+		}
+	}
+	return image.RegistryOptions{
+		Username:           c.String(RegistryUser),
+		Password:           c.String(RegistryPassword),
+		InsecureRegistries: c.StringSlice(InsecureRegistries),
+		Mirrors:            mirrors,
+		Proxy:              c.String(RegistryProxy),
+		CABundle:           c.String(RegistryCABundle),
+		AuthFile:           c.String(RegistryAuthFile),
+		RateLimit:          rateLimit,
+	}, nil
+}
+
+func convertOptions(c *cli.Context) image.ConvertOptions {
+	return image.ConvertOptions{
+		Mode:   c.String(ConvertMode),
+		Format: c.String(ImageFormat),
+	}
+}
+
+func gcOptions(c *cli.Context) image.GCOptions {
+	return image.GCOptions{
+		MinAge:        c.Duration(GCMinAge),
+		KeepLast:      c.Int(GCKeepLast),
+		StoragePool:   c.String(StoragePool),
+		HighWaterMark: c.Float64(GCHighWaterMark),
+		DryRun:        c.Bool(GCDryRun),
+	}
+}
+
 func startManage(c *cli.Context) error {
 	//watch os signal
 	util.ListenSignals(CleanupManage)
+	if c.Int64(StatusPort) != 0 {
+		go util.ServerStatus(util.StatusHandlers{
+			"/healthz":         manageStatusHandler,
+			"/images/progress": imageHandler.ProgressHandler,
+			"/images/status":   imageHandler.StateHandler,
+		}, c.Int64(StatusPort))
+	}
 	if lxdClient == nil {
 		//It's not guaranteed we do have lxd server on all node. we can fail to sleep infinitely in case of this.
 		imageHandler.FakeLoop()
@@ -159,6 +348,11 @@ func startManage(c *cli.Context) error {
 	return nil
 }
 
+func manageStatusHandler(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("image manager alive"))
+}
+
 func CleanupManage() {
 	if imageHandler != nil {
 		imageHandler.Close()
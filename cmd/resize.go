@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+
+	"lxc-launcher/log"
+	"lxc-launcher/lxd"
+
+	"github.com/urfave/cli/v2"
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+)
+
+// resizeRequest is the body of resize endpoint on launch status server
+type resizeRequest struct {
+	CPU        string `json:"cpu"`
+	Memory     string `json:"memory"`
+	Processes  string `json:"processes"`
+	Ingress    string `json:"ingress"`
+	Egress     string `json:"egress"`
+	RootSize   string `json:"rootSize"`
+	DeviceName string `json:"deviceName"`
+}
+
+func (r resizeRequest) toSpec(defaultDevice string) lxd.ResourceSpec {
+	deviceName := r.DeviceName
+	if len(deviceName) == 0 {
+		deviceName = defaultDevice
+	}
+	return lxd.ResourceSpec{
+		DeviceName: deviceName,
+		RootSize:   r.RootSize,
+		Ingress:    r.Ingress,
+		Egress:     r.Egress,
+		CPU:        r.CPU,
+		Memory:     r.Memory,
+		Processes:  r.Processes,
+	}
+}
+
+var resizeCommand = &cli.Command{
+	Name:    "resize",
+	Aliases: []string{"r"},
+	Usage:   "Resize a running lxc instance without restarting: launcher resize <instance-name>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    LXDSocket,
+			Aliases: []string{"l"},
+			Value:   "",
+			Usage:   "lxd socket file for communicating",
+			EnvVars: []string{GenerateEnvFlags(LXDSocket)},
+		},
+		&cli.StringFlag{
+			Name:    LXDServerAddress,
+			Aliases: []string{"s"},
+			Value:   "",
+			Usage:   "lxd server address for communication, only work when lxd socket not specified",
+			EnvVars: []string{GenerateEnvFlags(LXDServerAddress)},
+		},
+		&cli.StringFlag{
+			Name:    ClientKeyPath,
+			Aliases: []string{"k"},
+			Value:   "",
+			Usage:   "key path for lxd client authentication, only work when lxd socket not specified",
+			EnvVars: []string{GenerateEnvFlags(ClientKeyPath)},
+		},
+		&cli.StringFlag{
+			Name:    ClientCertPath,
+			Aliases: []string{"c"},
+			Value:   "",
+			Usage:   "cert path for lxd client authentication, only work when lxd socket not specified",
+			EnvVars: []string{GenerateEnvFlags(ClientCertPath)},
+		},
+		&cli.StringFlag{
+			Name:    CPUResource,
+			Aliases: []string{"rc"},
+			Value:   "",
+			Usage:   "CPU limitation of lxc instance, in cores (2, 0.5), millicores (500m) or percentage (50%)",
+			EnvVars: []string{GenerateEnvFlags(CPUResource)},
+		},
+		&cli.StringFlag{
+			Name:    ProcessResource,
+			Aliases: []string{"rp"},
+			Value:   "",
+			Usage:   "Process limitation of lxc instance",
+			EnvVars: []string{GenerateEnvFlags(ProcessResource)},
+		},
+		&cli.StringFlag{
+			Name:    MemoryResource,
+			Aliases: []string{"rm"},
+			Value:   "",
+			Usage:   "Memory limitation of lxc instance, in quantity (512Mi, 2G, 1GiB) or percentage (50%)",
+			EnvVars: []string{GenerateEnvFlags(MemoryResource)},
+		},
+		&cli.StringFlag{
+			Name:    RootSize,
+			Aliases: []string{"rd"},
+			Value:   "",
+			Usage:   "Root size for lxc instance, can only be grown when storage driver supports",
+			EnvVars: []string{GenerateEnvFlags(RootSize)},
+		},
+		&cli.StringFlag{
+			Name:    NetworkIngress,
+			Aliases: []string{"ri"},
+			Value:   "",
+			Usage:   "Ingress limit for lxc instance, in bit/s quantity (100M, 100Mbit, 1Gibit)",
+			EnvVars: []string{GenerateEnvFlags(NetworkIngress)},
+		},
+		&cli.StringFlag{
+			Name:    NetworkEgress,
+			Aliases: []string{"re"},
+			Value:   "",
+			Usage:   "Egress limit for lxc instance, in bit/s quantity (100M, 100Mbit, 1Gibit)",
+			EnvVars: []string{GenerateEnvFlags(NetworkEgress)},
+		},
+		&cli.StringFlag{
+			Name:    DeviceName,
+			Aliases: []string{"dn"},
+			Value:   "eth0",
+			Usage:   "network device name which bandwidth limitation applied to",
+			EnvVars: []string{GenerateEnvFlags(DeviceName)},
+		},
+	},
+	Before: validateResize,
+	Action: handleResize,
+}
+
+func validateResize(c *cli.Context) error {
+	var err error
+	if c.Args().Len() < 1 {
+		return errors.New("require instance name")
+	}
+	instName = c.Args().Get(0)
+	if (len(c.String(LXDSocket)) == 0 || !fileutil.Exist(c.String(LXDSocket))) && len(c.String(LXDServerAddress)) == 0 {
+		return errors.New(fmt.Sprintf("lxd socket file %s not existed and lxd server address %s not specified",
+			c.String(LXDSocket), c.String(LXDServerAddress)))
+	}
+	serverAddress := c.String(LXDServerAddress)
+	if net.ParseIP(c.String(LXDServerAddress)) != nil {
+		serverAddress = fmt.Sprintf("https://%s:8443", c.String(LXDServerAddress))
+	}
+	if lxdClient, err = lxd.NewClient(c.String(LXDSocket), serverAddress, c.String(ClientKeyPath),
+		c.String(ClientCertPath), log.Logger); err != nil {
+		return err
+	}
+	return nil
+}
+
+func handleResize(c *cli.Context) error {
+	request := resizeRequest{
+		CPU:       c.String(CPUResource),
+		Memory:    c.String(MemoryResource),
+		Processes: c.String(ProcessResource),
+		Ingress:   c.String(NetworkIngress),
+		Egress:    c.String(NetworkEgress),
+		RootSize:  c.String(RootSize),
+	}
+	if err := lxdClient.ResizeInstance(instName, request.toSpec(c.String(DeviceName))); err != nil {
+		log.Logger.Error(fmt.Sprintf("failed to resize instance %s, %s", instName, err))
+		return err
+	}
+	log.Logger.Info(fmt.Sprintf("instance %s resized", instName))
+	return nil
+}
+
+// authorizeResize checks resize request carries the bearer token, requests are only allowed from loopback
+// addresses when no token specified since status server listens on all interfaces.
+func authorizeResize(req *http.Request, token string) (int, error) {
+	if len(token) != 0 {
+		expected := []byte(fmt.Sprintf("Bearer %s", token))
+		if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+			return http.StatusUnauthorized, errors.New("resize token incorrect")
+		}
+		return http.StatusOK, nil
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return http.StatusForbidden, errors.New(fmt.Sprintf("remote address %s incorrect", req.RemoteAddr))
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return http.StatusForbidden, errors.New(fmt.Sprintf(
+			"resize from %s not allowed without resize token", host))
+	}
+	return http.StatusOK, nil
+}
+
+// resizeStatusHandler resizes the launched instance with limitation in request body
+func resizeStatusHandler(deviceName, token string) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			w.Write([]byte("only POST method supported"))
+			return
+		}
+		if code, err := authorizeResize(req, token); err != nil {
+			log.Logger.Warn(fmt.Sprintf("resize request rejected, %s", err))
+			w.WriteHeader(code)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		var request resizeRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("failed to decode resize request, %s", err)))
+			return
+		}
+		if err := lxdClient.ResizeInstance(instName, request.toSpec(deviceName)); err != nil {
+			log.Logger.Error(fmt.Sprintf("failed to resize instance %s, %s", instName, err))
+			if _, ok := err.(*lxd.InvalidLimitError); ok {
+				w.WriteHeader(http.StatusBadRequest)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			w.Write([]byte(fmt.Sprintf("failed to resize instance %s, %s", instName, err)))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("instance %s resized", instName)))
+	}
+}
@@ -0,0 +1,276 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+const (
+	AUTH_SCHEME_BEARER = "bearer"
+	AUTH_SCHEME_BASIC  = "basic"
+	WWW_AUTHENTICATE   = "WWW-Authenticate"
+)
+
+// authChallenge is the challenge returned in WWW-Authenticate header when registry requires authorization
+type authChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// parseAuthChallenge parses WWW-Authenticate header, for instance:
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseAuthChallenge(header string) *authChallenge {
+	header = strings.TrimSpace(header)
+	if len(header) == 0 {
+		return nil
+	}
+	challenge := &authChallenge{Params: map[string]string{}}
+	parts := strings.SplitN(header, " ", 2)
+	challenge.Scheme = strings.ToLower(parts[0])
+	if len(parts) == 1 {
+		return challenge
+	}
+	params := parts[1]
+	for len(params) != 0 {
+		params = strings.TrimLeft(params, ", ")
+		index := strings.Index(params, "=")
+		if index == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(params[:index]))
+		params = params[index+1:]
+		var value string
+		if strings.HasPrefix(params, "\"") {
+			end := strings.Index(params[1:], "\"")
+			if end == -1 {
+				value = params[1:]
+				params = ""
+			} else {
+				value = params[1 : end+1]
+				params = params[end+2:]
+			}
+		} else {
+			end := strings.Index(params, ",")
+			if end == -1 {
+				value = params
+				params = ""
+			} else {
+				value = params[:end]
+				params = params[end:]
+			}
+		}
+		challenge.Params[key] = strings.TrimSpace(value)
+	}
+	return challenge
+}
+
+type tokenResponse struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// registryEndpoint is the upstream registry or one of its mirrors, each of them has its own authorization state
+type registryEndpoint struct {
+	// api endpoint in the format of <scheme>://<host>/v2
+	url        string
+	host       string
+	mirror     bool
+	repository string
+	username   string
+	password   string
+	logger     *zap.Logger
+	// endpoint is skipped once it's unreachable
+	failed *atomic.Bool
+
+	mutex           sync.Mutex
+	discovered      bool
+	authScheme      string
+	authEndpoint    string
+	serviceName     string
+	registryToken   string
+	tokenExpiration time.Time
+}
+
+func newRegistryEndpoint(endpoint, repository, username, password string, mirror bool,
+	logger *zap.Logger) (*registryEndpoint, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Host) == 0 {
+		return nil, errors.New(fmt.Sprintf("registry endpoint %s incorrect", endpoint))
+	}
+	return &registryEndpoint{
+		url:        fmt.Sprintf("%s://%s%s/v2", u.Scheme, u.Host, strings.TrimRight(u.Path, "/")),
+		host:       u.Host,
+		mirror:     mirror,
+		repository: repository,
+		username:   username,
+		password:   password,
+		logger:     logger,
+		failed:     atomic.NewBool(false),
+	}, nil
+}
+
+// discover detects the authorization required by registry from the WWW-Authenticate challenge, it's performed
+// only once for each endpoint.
+func (e *registryEndpoint) discover(client *http.Client) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.discovered {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(DEFAULT_TIMEOUT)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/", e.url), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		e.discovered = true
+		return nil
+	}
+	challenge := parseAuthChallenge(resp.Header.Get(WWW_AUTHENTICATE))
+	if challenge == nil {
+		return errors.New(fmt.Sprintf("registry %s requires authorization without challenge", e.url))
+	}
+	e.authScheme = challenge.Scheme
+	switch challenge.Scheme {
+	case AUTH_SCHEME_BEARER:
+		e.authEndpoint = challenge.Params["realm"]
+		e.serviceName = challenge.Params["service"]
+		if len(e.authEndpoint) == 0 {
+			return errors.New(fmt.Sprintf("registry %s bearer challenge without realm", e.url))
+		}
+		if err = e.refreshToken(client); err != nil {
+			return err
+		}
+	case AUTH_SCHEME_BASIC:
+		if len(e.username) == 0 || len(e.password) == 0 {
+			return errors.New(fmt.Sprintf("registry %s requires basic authorization", e.url))
+		}
+	default:
+		return errors.New(fmt.Sprintf("unsupported authorization scheme %s of registry %s",
+			challenge.Scheme, e.url))
+	}
+	e.discovered = true
+	return nil
+}
+
+// authorize adds authorization header into request, token is refreshed via client when expired
+func (e *registryEndpoint) authorize(client *http.Client, req *http.Request) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	switch e.authScheme {
+	case AUTH_SCHEME_BEARER:
+		if !e.tokenValid() {
+			if err := e.refreshToken(client); err != nil {
+				return err
+			}
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", e.registryToken))
+	case AUTH_SCHEME_BASIC:
+		req.SetBasicAuth(e.username, e.password)
+	}
+	return nil
+}
+
+func (e *registryEndpoint) tokenValid() bool {
+	if len(e.registryToken) == 0 {
+		return false
+	}
+	now := time.Now()
+	if now.After(e.tokenExpiration) {
+		return false
+	}
+	return true
+}
+
+func (e *registryEndpoint) refreshToken(client *http.Client) error {
+	e.logger.Info(fmt.Sprintf("start to refresh registry token of %s for repository %s", e.host, e.repository))
+	reqUrl, err := url.Parse(e.authEndpoint)
+	if err != nil {
+		return err
+	}
+	query := reqUrl.Query()
+	if len(e.serviceName) != 0 {
+		query.Set("service", e.serviceName)
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", e.repository))
+	reqUrl.RawQuery = query.Encode()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(DEFAULT_TIMEOUT)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", reqUrl.String(), nil)
+	if err != nil {
+		return err
+	}
+	if len(e.username) != 0 && len(e.password) != 0 {
+		req.SetBasicAuth(e.username, e.password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(fmt.Sprintf("failed to refresh registry token: %s", string(bodyBytes)))
+	}
+	decoder := json.NewDecoder(resp.Body)
+	var tr tokenResponse
+	if err = decoder.Decode(&tr); err != nil {
+		return errors.New(fmt.Sprintf("failed to decode registry token: %s", err))
+	}
+	e.registryToken = tr.Token
+	if len(e.registryToken) == 0 {
+		e.registryToken = tr.AccessToken
+	}
+	if tr.ExpiresIn == 0 {
+		tr.ExpiresIn = DEFAULT_TOKEN_EXPIRATION
+	}
+	if tr.IssuedAt.IsZero() {
+		tr.IssuedAt = time.Now().UTC()
+	}
+	e.tokenExpiration = tr.IssuedAt.Add(time.Duration(tr.ExpiresIn) * time.Second)
+	return nil
+}
+
+// authTransport authorizes requests sent to registry endpoints, requests redirected to other hosts such as
+// blob storage are sent without authorization.
+type authTransport struct {
+	base http.RoundTripper
+	// client without authorization used to request tokens
+	client    *http.Client
+	endpoints map[string]*registryEndpoint
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	endpoint, ok := t.endpoints[req.URL.Host]
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	// round tripper must not modify the original request
+	req = req.Clone(req.Context())
+	if err := endpoint.authorize(t.client, req); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
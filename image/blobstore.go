@@ -0,0 +1,350 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+	"go.uber.org/zap"
+)
+
+const (
+	BLOBS_DIR      = "blobs"
+	PARTIAL_SUFFIX = ".partial"
+	// lock file of blob shared by processes on the same node, they are kept after blob removed
+	LOCK_SUFFIX = ".lock"
+	// partial downloads untouched for this long are considered abandoned and collected
+	PARTIAL_EXPIRATION = 24 * time.Hour
+)
+
+// blobFetcher requests blob content starting from offset, Range header should be set when offset is not zero
+type blobFetcher func(offset int64) (*http.Response, error)
+
+// BlobStore is the content addressed blob cache shared across images and workers, blobs are stored in
+// <base-folder>/blobs/<algorithm>/<hex> and only visible after their digest verified. Since launchers share the
+// store with manage command, blobs pinned are also locked in <hex>.lock with shared flock, and written with
+// exclusive flock.
+type BlobStore struct {
+	folder string
+	logger *zap.Logger
+	mutex  sync.Mutex
+	// serializes operations on the same blob
+	locks *keyLocks
+	// blobs fetched by pulls in progress, they are not collected until released
+	pins map[string]int
+	// lock files of blobs pinned, the flock is held until blob released
+	lockFiles map[string]*os.File
+}
+
+func NewBlobStore(baseFolder string, logger *zap.Logger) (*BlobStore, error) {
+	folder := filepath.Join(baseFolder, BLOBS_DIR)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, err
+	}
+	return &BlobStore{
+		folder:    folder,
+		logger:    logger,
+		locks:     newKeyLocks(),
+		pins:      map[string]int{},
+		lockFiles: map[string]*os.File{},
+	}, nil
+}
+
+// Path returns the file path of blob, the blob may not exist. Digest is validated strictly since it comes from
+// manifest and it's joined into path.
+func (s *BlobStore) Path(digest string) (string, error) {
+	if err := ValidateDigest(digest); err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(digest, ":", 2)
+	return filepath.Join(s.folder, parts[0], parts[1]), nil
+}
+
+// Exists checks whether blob file is cached, blobs of invalid digest never exist. The content is not verified,
+// Fetch verifies it before the blob is used.
+func (s *BlobStore) Exists(digest string) bool {
+	blobPath, err := s.Path(digest)
+	if err != nil {
+		return false
+	}
+	return fileutil.Exist(blobPath)
+}
+
+// Release unpins the blob fetched, it can be collected afterwards if no image refers to it
+func (s *BlobStore) Release(digest string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.pins[digest] -= 1
+	if s.pins[digest] <= 0 {
+		delete(s.pins, digest)
+		if file, ok := s.lockFiles[digest]; ok {
+			file.Close()
+			delete(s.lockFiles, digest)
+		}
+	}
+}
+
+// lockFile returns lock file of blob with shared flock, the file is kept open by this process until blob released
+func (s *BlobStore) lockFile(ctx context.Context, digest, blobPath string) (*os.File, error) {
+	s.mutex.Lock()
+	file, ok := s.lockFiles[digest]
+	s.mutex.Unlock()
+	if !ok {
+		if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+			return nil, err
+		}
+		var err error
+		if file, err = os.OpenFile(blobPath+LOCK_SUFFIX, os.O_WRONLY|os.O_CREATE, fileutil.PrivateFileMode); err != nil {
+			return nil, err
+		}
+		s.mutex.Lock()
+		s.lockFiles[digest] = file
+		s.mutex.Unlock()
+	}
+	if err := flockFile(ctx, file, syscall.LOCK_SH); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *BlobStore) pinned(digest string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.pins[digest] > 0
+}
+
+// Fetch downloads blob into store if not cached, interrupted download is resumed from the partial file via
+// HTTP Range request, the content is verified against digest before it's visible. The blob is pinned until
+// Release is invoked no matter whether fetch succeeds, so that it's neither collected by this process nor others.
+func (s *BlobStore) Fetch(ctx context.Context, digest string, fetch blobFetcher) (string, error) {
+	blobPath, err := s.Path(digest)
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	s.pins[digest] += 1
+	s.mutex.Unlock()
+	unlock := s.locks.Lock(digest)
+	defer unlock()
+	lockFile, err := s.lockFile(ctx, digest, blobPath)
+	if err != nil {
+		return "", err
+	}
+	if fileutil.Exist(blobPath) && s.verify(digest, blobPath) == nil {
+		return blobPath, nil
+	}
+	// shared lock is released before waiting for exclusive lock, otherwise processes downloading the same blob
+	// wait for each other
+	if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN); err != nil {
+		return "", err
+	}
+	if err = flockFile(ctx, lockFile, syscall.LOCK_EX); err != nil {
+		return "", err
+	}
+	if err = s.write(ctx, digest, blobPath, fetch); err != nil {
+		return "", err
+	}
+	if err = flockFile(ctx, lockFile, syscall.LOCK_SH); err != nil {
+		return "", err
+	}
+	return blobPath, nil
+}
+
+// write downloads blob while holding exclusive lock, blob downloaded by others in the meantime is reused
+func (s *BlobStore) write(ctx context.Context, digest, blobPath string, fetch blobFetcher) error {
+	if fileutil.Exist(blobPath) {
+		err := s.verify(digest, blobPath)
+		if err == nil {
+			return nil
+		}
+		s.logger.Warn(fmt.Sprintf("cached blob %s corrupted and downloaded again, %s", digest, err))
+		if err = os.Remove(blobPath); err != nil {
+			return err
+		}
+	}
+	return s.download(ctx, digest, blobPath, fetch)
+}
+
+// verify checks content of cached blob against digest
+func (s *BlobStore) verify(digest, blobPath string) error {
+	verifier, err := newDigestVerifier(digest)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = io.Copy(verifier, file); err != nil {
+		return err
+	}
+	return verifier.Verify()
+}
+
+func (s *BlobStore) download(ctx context.Context, digest, blobPath string, fetch blobFetcher) error {
+	partialPath := blobPath + PARTIAL_SUFFIX
+	verifier, err := newDigestVerifier(digest)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	offset, err := io.Copy(verifier, file)
+	if err != nil {
+		return err
+	}
+	if offset != 0 {
+		s.logger.Info(fmt.Sprintf("resume downloading blob %s from offset %d", digest, offset))
+	}
+	resp, err := fetch(offset)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset != 0:
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		//range not supported or partial file invalid, start over
+		if offset != 0 {
+			s.logger.Info(fmt.Sprintf("unable to resume blob %s, response code %d, start over", digest,
+				resp.StatusCode))
+			if verifier, err = newDigestVerifier(digest); err != nil {
+				return err
+			}
+			if err = file.Truncate(0); err != nil {
+				return err
+			}
+			if _, err = file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return errors.New(fmt.Sprintf("blob %s range not satisfiable, partial download discarded", digest))
+		}
+	default:
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(fmt.Sprintf("request %s response code incorrect expected %d got %d and response %s",
+			resp.Request.URL.String(), http.StatusOK, resp.StatusCode, string(bodyBytes)))
+	}
+	if _, err = file.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err = io.Copy(io.MultiWriter(file, verifier), &contextReader{ctx: ctx, reader: resp.Body}); err != nil {
+		return err
+	}
+	if err = verifier.Verify(); err != nil {
+		_ = os.Remove(partialPath)
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(partialPath, blobPath)
+}
+
+// GarbageCollect removes the blobs neither referenced nor pinned as well as abandoned partial downloads, blobs
+// locked by other processes are skipped.
+func (s *BlobStore) GarbageCollect(referenced map[string]bool) (int, error) {
+	removed := 0
+	err := filepath.Walk(s.folder, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(filePath, LOCK_SUFFIX) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.folder, filePath)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(rel, PARTIAL_SUFFIX) {
+			if time.Since(info.ModTime()) < PARTIAL_EXPIRATION {
+				return nil
+			}
+			rel = strings.TrimSuffix(rel, PARTIAL_SUFFIX)
+		}
+		digest := strings.Replace(filepath.ToSlash(rel), "/", ":", 1)
+		if referenced[digest] && !strings.HasSuffix(filePath, PARTIAL_SUFFIX) {
+			return nil
+		}
+		unlock := s.locks.Lock(digest)
+		defer unlock()
+		if s.pinned(digest) {
+			return nil
+		}
+		blobPath := strings.TrimSuffix(filePath, PARTIAL_SUFFIX)
+		// flock is used rather than fileutil lock, which takes fcntl lock not conflicting with flock
+		lockFile, err := os.OpenFile(blobPath+LOCK_SUFFIX, os.O_WRONLY|os.O_CREATE, fileutil.PrivateFileMode)
+		if err != nil {
+			return err
+		}
+		defer lockFile.Close()
+		if err = syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			if err != syscall.EWOULDBLOCK {
+				return err
+			}
+			s.logger.Info(fmt.Sprintf("skip collecting blob %s locked by others", rel))
+			return nil
+		}
+		s.logger.Info(fmt.Sprintf("remove unreferenced blob %s", rel))
+		if err = os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed += 1
+		return nil
+	})
+	return removed, err
+}
+
+// ReferencedBlobs returns the layer digests recorded in verified digests of image folders inside of base folder
+func ReferencedBlobs(baseFolder string) (map[string]bool, error) {
+	referenced := map[string]bool{}
+	entries, err := ioutil.ReadDir(baseFolder)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == BLOBS_DIR {
+			continue
+		}
+		imageFolder := filepath.Join(baseFolder, entry.Name())
+		if !fileutil.Exist(filepath.Join(imageFolder, VERIFIED_DIGESTS)) {
+			continue
+		}
+		digests, err := ReadVerifiedDigests(imageFolder)
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range digests.Layers {
+			referenced[layer] = true
+		}
+	}
+	return referenced, nil
+}
+
+// contextReader stops reading once context canceled
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
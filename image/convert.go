@@ -0,0 +1,310 @@
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/lxc/lxd/shared/api"
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	CONVERT_MODE_AUTO    = "auto"
+	CONVERT_MODE_ALWAYS  = "always"
+	CONVERT_MODE_NEVER   = "never"
+	IMAGE_FORMAT_UNIFIED = "unified"
+	IMAGE_FORMAT_SPLIT   = "split"
+	// folder inside of image folder which contains the converted lxd image files
+	CONVERTED_DIR  = "lxd"
+	METADATA_FILE  = "metadata.yaml"
+	TEMPLATES_DIR  = "templates"
+	UNIFIED_IMAGE  = "image.tar.gz"
+	METADATA_IMAGE = "metadata.tar.gz"
+	MKSQUASHFS     = "mksquashfs"
+)
+
+// lxdTemplates are the templates rendered by lxd when instance created or copied
+var lxdTemplates = map[string]string{
+	"hostname.tpl": "{{ container.name }}\n",
+	"hosts.tpl":    "127.0.0.1\tlocalhost\n127.0.1.1\t{{ container.name }}\n",
+}
+
+// ConvertOptions controls how ordinary OCI images are converted into lxd images
+type ConvertOptions struct {
+	// auto converts images without prebuilt lxd.tar.xz, always converts all images and never disables conversion
+	Mode string
+	// unified packs metadata and rootfs into one tarball, split packs rootfs into squashfs via mksquashfs
+	Format string
+}
+
+func (o *ConvertOptions) Validate() error {
+	switch o.Mode {
+	case "", CONVERT_MODE_AUTO, CONVERT_MODE_ALWAYS, CONVERT_MODE_NEVER:
+	default:
+		return errors.New(fmt.Sprintf("unsupported convert mode %s", o.Mode))
+	}
+	switch o.Format {
+	case "", IMAGE_FORMAT_UNIFIED:
+	case IMAGE_FORMAT_SPLIT:
+		if _, err := exec.LookPath(MKSQUASHFS); err != nil {
+			return errors.New(fmt.Sprintf("%s is required for split image format, %s", MKSQUASHFS, err))
+		}
+	default:
+		return errors.New(fmt.Sprintf("unsupported image format %s", o.Format))
+	}
+	return nil
+}
+
+// imageConfig is the subset of OCI image configuration used for lxd metadata
+type imageConfig struct {
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	Variant      string    `json:"variant"`
+	Created      time.Time `json:"created"`
+}
+
+// needsConversion returns whether the extracted rootfs is an ordinary OCI image rather than prebuilt lxd image
+func (p *Puller) needsConversion() bool {
+	switch p.convertOptions.Mode {
+	case CONVERT_MODE_NEVER:
+		return false
+	case CONVERT_MODE_ALWAYS:
+		return true
+	}
+	return !fileutil.Exist(filepath.Join(p.imageFolder, ROOTFS_DIR, LXD_TYPE))
+}
+
+// convertImage generates lxd metadata for the flattened rootfs and packs them into lxd image files
+func (p *Puller) convertImage(ctx context.Context) error {
+	p.logger.Info(fmt.Sprintf("start to convert image %s:%s into %s lxd image", p.imageName, p.imageTag,
+		p.convertOptions.Format))
+	rootfs := filepath.Join(p.imageFolder, ROOTFS_DIR)
+	if !fileutil.Exist(filepath.Join(rootfs, "sbin", "init")) {
+		p.logger.Warn(fmt.Sprintf("image %s:%s doesn't contain /sbin/init, instance may fail to start",
+			p.imageName, p.imageTag))
+	}
+	metadata, err := p.generateMetadata(ctx)
+	if err != nil {
+		return err
+	}
+	// rootfs folder is created privately, it's the root directory of instance though
+	if err = os.Chmod(rootfs, 0755); err != nil {
+		return err
+	}
+	convertedFolder := filepath.Join(p.imageFolder, CONVERTED_DIR)
+	tmpFolder := fmt.Sprintf("%s.tmp", convertedFolder)
+	if err = os.RemoveAll(tmpFolder); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(tmpFolder, 0755); err != nil {
+		return err
+	}
+	if p.convertOptions.Format == IMAGE_FORMAT_SPLIT {
+		if err = writeLXDTarball(filepath.Join(tmpFolder, METADATA_IMAGE), metadata, ""); err != nil {
+			return err
+		}
+		output, err := exec.CommandContext(ctx, MKSQUASHFS, rootfs, filepath.Join(tmpFolder, CONTAINER_TYPE),
+			"-noappend", "-no-progress").CombinedOutput()
+		if err != nil {
+			return errors.New(fmt.Sprintf("failed to pack rootfs into squashfs, %s, %s", err, string(output)))
+		}
+	} else {
+		if err = writeLXDTarball(filepath.Join(tmpFolder, UNIFIED_IMAGE), metadata, rootfs); err != nil {
+			return err
+		}
+	}
+	if err = os.RemoveAll(convertedFolder); err != nil {
+		return err
+	}
+	return os.Rename(tmpFolder, convertedFolder)
+}
+
+func (p *Puller) generateMetadata(ctx context.Context) ([]byte, error) {
+	config, err := p.getImageConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var architecture string
+	if len(config.Architecture) != 0 {
+		architecture = KernelArchitectureFromPlatform(config.Architecture, config.Variant)
+	} else {
+		architecture = KernelArchitectureFromPlatform(p.getPlatform())
+	}
+	created := config.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	metadata := api.ImageMetadata{
+		Architecture: architecture,
+		CreationDate: created.Unix(),
+		Properties: map[string]string{
+			"description":   p.reference.String(),
+			"name":          p.reference.Name(),
+			"os":            config.OS,
+			"architecture":  architecture,
+			"oci.reference": p.reference.String(),
+			"oci.digest":    p.manifestDigest,
+		},
+		Templates: map[string]*api.ImageMetadataTemplate{
+			"/etc/hostname": {
+				When:     []string{"create", "copy"},
+				Template: "hostname.tpl",
+			},
+			"/etc/hosts": {
+				When:     []string{"create", "copy"},
+				Template: "hosts.tpl",
+			},
+		},
+	}
+	return yaml.Marshal(&metadata)
+}
+
+// getImageConfig fetches and verifies the image configuration blob, it's empty for schema1 manifest
+func (p *Puller) getImageConfig(ctx context.Context) (*imageConfig, error) {
+	config := &imageConfig{}
+	if len(p.configDigest) == 0 {
+		return config, nil
+	}
+	defer p.blobStore.Release(p.configDigest)
+	configPath, err := p.blobStore.Fetch(ctx, p.configDigest, p.blobFetcher(ctx, p.configDigest))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to fetch config of image %s:%s, %s",
+			p.imageName, p.imageTag, err))
+	}
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(content, config); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to decode config of image %s:%s, %s",
+			p.imageName, p.imageTag, err))
+	}
+	return config, nil
+}
+
+// writeLXDTarball writes lxd image tarball with metadata and templates, the rootfs is included when specified
+// which makes it a unified image.
+func writeLXDTarball(dest string, metadata []byte, rootfs string) error {
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gWriter := gzip.NewWriter(file)
+	tw := tar.NewWriter(gWriter)
+	now := time.Now()
+	if err = writeTarFile(tw, METADATA_FILE, metadata, now); err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(&tar.Header{Name: TEMPLATES_DIR + "/", Typeflag: tar.TypeDir, Mode: 0755,
+		ModTime: now}); err != nil {
+		return err
+	}
+	var names []string
+	for name := range lxdTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = writeTarFile(tw, path.Join(TEMPLATES_DIR, name), []byte(lxdTemplates[name]), now); err != nil {
+			return err
+		}
+	}
+	if len(rootfs) != 0 {
+		if err = writeTarDirectory(tw, rootfs, ROOTFS_DIR); err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gWriter.Close(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(content)
+	return err
+}
+
+// writeTarDirectory adds directory into tarball under prefix with ownership, modes, links and devices kept
+func writeTarDirectory(tw *tar.Writer, dir, prefix string) error {
+	inodes := map[uint64]string{}
+	return filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(filePath); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(prefix, filepath.ToSlash(rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		// lxd unpacks with numeric ownership
+		hdr.Uname = ""
+		hdr.Gname = ""
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+			if first, ok := inodes[stat.Ino]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				inodes[stat.Ino] = hdr.Name
+			}
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+}
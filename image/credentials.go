@@ -0,0 +1,139 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// server address of docker hub used in docker config and credential helpers
+	DOCKER_HUB_INDEX          = "https://index.docker.io/v1/"
+	CREDENTIAL_HELPER_PREFIX  = "docker-credential-"
+	CREDENTIAL_HELPER_TIMEOUT = 10
+)
+
+// DockerConfig is the docker config.json as well as kubernetes dockerconfigjson secret, per registry credentials
+// are either stored in auths or provided by credential helpers.
+type DockerConfig struct {
+	Auths       map[string]DockerAuth `json:"auths"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+	CredsStore  string                `json:"credsStore"`
+}
+
+type DockerAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type credentialHelperResponse struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// LoadDockerConfig loads docker config file, the legacy dockercfg format without auths is supported as well
+func LoadDockerConfig(configFile string) (*DockerConfig, error) {
+	content, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	var config DockerConfig
+	if err = json.Unmarshal(content, &config); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to decode docker config %s, %s", configFile, err))
+	}
+	if len(config.Auths) == 0 && len(config.CredHelpers) == 0 && len(config.CredsStore) == 0 {
+		var auths map[string]DockerAuth
+		if err = json.Unmarshal(content, &auths); err == nil {
+			config.Auths = auths
+		}
+	}
+	return &config, nil
+}
+
+// normalizeRegistryHost converts server address in docker config into registry host, docker hub addresses
+// are all converted into docker.io
+func normalizeRegistryHost(address string) string {
+	host := address
+	if index := strings.Index(host, "://"); index != -1 {
+		host = host[index+3:]
+	}
+	if index := strings.Index(host, "/"); index != -1 {
+		host = host[:index]
+	}
+	switch host {
+	case "index.docker.io", DOCKER_HUB_REGISTRY:
+		return DOCKER_HUB
+	}
+	return host
+}
+
+// Credentials returns username and password for registry host, found is false if no credentials configured
+func (c *DockerConfig) Credentials(host string) (string, string, bool, error) {
+	host = normalizeRegistryHost(host)
+	helper, ok := c.CredHelpers[host]
+	if !ok && host == DOCKER_HUB {
+		helper, ok = c.CredHelpers[DOCKER_HUB_INDEX]
+	}
+	if ok {
+		return c.helperCredentials(helper, host)
+	}
+	for address, auth := range c.Auths {
+		if normalizeRegistryHost(address) != host {
+			continue
+		}
+		if len(auth.Auth) != 0 {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return "", "", false, errors.New(fmt.Sprintf("auth of registry %s incorrect, %s", address, err))
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return "", "", false, errors.New(fmt.Sprintf("auth of registry %s incorrect", address))
+			}
+			return parts[0], parts[1], true, nil
+		}
+		return auth.Username, auth.Password, true, nil
+	}
+	if len(c.CredsStore) != 0 {
+		return c.helperCredentials(c.CredsStore, host)
+	}
+	return "", "", false, nil
+}
+
+// helperCredentials gets credentials via docker-credential-<helper> get
+func (c *DockerConfig) helperCredentials(helper, host string) (string, string, bool, error) {
+	serverURL := host
+	if host == DOCKER_HUB {
+		serverURL = DOCKER_HUB_INDEX
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), CREDENTIAL_HELPER_TIMEOUT*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, CREDENTIAL_HELPER_PREFIX+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		output := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(output, "credentials not found") {
+			return "", "", false, nil
+		}
+		return "", "", false, errors.New(fmt.Sprintf("credential helper %s failed for registry %s, %s, %s",
+			helper, host, err, output))
+	}
+	var resp credentialHelperResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return "", "", false, errors.New(fmt.Sprintf("failed to decode output of credential helper %s, %s",
+			helper, err))
+	}
+	return resp.Username, resp.Secret, true, nil
+}
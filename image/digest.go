@@ -0,0 +1,106 @@
+package image
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	VERIFIED_DIGESTS = "verified.json"
+)
+
+// VerifiedDigests records the manifest and layer digests verified during the last pull of image
+type VerifiedDigests struct {
+	// digest of the manifest fetched by tag, which could be an index
+	Index      string    `json:"index,omitempty"`
+	Manifest   string    `json:"manifest"`
+	Layers     []string  `json:"layers"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+}
+
+// supported digest algorithms and the format of digests, digests are used as blob paths so that nothing else is
+// accepted
+var digestPatterns = map[string]*regexp.Regexp{
+	"sha256": regexp.MustCompile(`^sha256:[a-f0-9]{64}$`),
+	"sha512": regexp.MustCompile(`^sha512:[a-f0-9]{128}$`),
+}
+
+// ValidateDigest checks digest is in the format of <algorithm>:<hex> with supported algorithm
+func ValidateDigest(digest string) error {
+	algorithm := strings.SplitN(digest, ":", 2)[0]
+	pattern, ok := digestPatterns[algorithm]
+	if !ok {
+		return errors.New(fmt.Sprintf("unsupported digest algorithm %s", algorithm))
+	}
+	if !pattern.MatchString(digest) {
+		return errors.New(fmt.Sprintf("digest %s incorrect", digest))
+	}
+	return nil
+}
+
+// digestVerifier computes the hash of content and compares with expected digest in the format of <algorithm>:<hex>
+type digestVerifier struct {
+	digest string
+	hash   hash.Hash
+}
+
+func newDigestVerifier(digest string) (*digestVerifier, error) {
+	if err := ValidateDigest(digest); err != nil {
+		return nil, err
+	}
+	verifier := &digestVerifier{digest: digest}
+	if strings.HasPrefix(digest, "sha512:") {
+		verifier.hash = sha512.New()
+	} else {
+		verifier.hash = sha256.New()
+	}
+	return verifier, nil
+}
+
+func (v *digestVerifier) Write(p []byte) (int, error) {
+	return v.hash.Write(p)
+}
+
+func (v *digestVerifier) Verify() error {
+	actual := fmt.Sprintf("%s:%s", strings.SplitN(v.digest, ":", 2)[0], hex.EncodeToString(v.hash.Sum(nil)))
+	if actual != v.digest {
+		return errors.New(fmt.Sprintf("digest mismatch, expected %s got %s", v.digest, actual))
+	}
+	return nil
+}
+
+// sha256Digest returns the sha256 digest of content in the format of sha256:<hex>
+func sha256Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return fmt.Sprintf("sha256:%s", hex.EncodeToString(sum[:]))
+}
+
+func WriteVerifiedDigests(imageFolder string, digests VerifiedDigests) error {
+	content, err := json.MarshalIndent(digests, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(imageFolder, VERIFIED_DIGESTS), content, 0644)
+}
+
+func ReadVerifiedDigests(imageFolder string) (*VerifiedDigests, error) {
+	content, err := ioutil.ReadFile(filepath.Join(imageFolder, VERIFIED_DIGESTS))
+	if err != nil {
+		return nil, err
+	}
+	var digests VerifiedDigests
+	if err = json.Unmarshal(content, &digests); err != nil {
+		return nil, err
+	}
+	return &digests, nil
+}
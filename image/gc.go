@@ -0,0 +1,171 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lxc/lxd/shared/api"
+)
+
+const (
+	// images younger than it are never collected, which protects images created but not aliased yet
+	DEFAULT_GC_MIN_AGE = time.Hour
+	GC_REASON_ALIASED  = "aliased"
+	GC_REASON_CACHED   = "cached"
+	GC_REASON_IN_USE   = "in use"
+	GC_REASON_TOO_NEW  = "too new"
+	GC_REASON_KEEP     = "keep last"
+)
+
+// GCOptions is the policy of collecting lxd images which are not aliased by any image version
+type GCOptions struct {
+	// images uploaded or used within min age are kept
+	MinAge time.Duration
+	// the newest unaliased images kept regardless of age
+	KeepLast int
+	// storage pool whose usage is checked against high water mark
+	StoragePool string
+	// images are only collected when usage percentage of storage pool exceeds it, and collecting stops
+	// once usage drops below, 0 means images are always collected
+	HighWaterMark float64
+	// report images which would be collected without deleting them
+	DryRun bool
+}
+
+func (o *GCOptions) Validate() error {
+	if o.MinAge < 0 {
+		return errors.New(fmt.Sprintf("image gc min age %s incorrect", o.MinAge))
+	}
+	if o.KeepLast < 0 {
+		return errors.New(fmt.Sprintf("image gc keep last %d incorrect", o.KeepLast))
+	}
+	if o.HighWaterMark < 0 || o.HighWaterMark > 100 {
+		return errors.New(fmt.Sprintf("image gc high water mark %.1f incorrect, expected percentage", o.HighWaterMark))
+	}
+	if o.HighWaterMark != 0 && len(o.StoragePool) == 0 {
+		return errors.New("storage pool is required when image gc high water mark specified")
+	}
+	return nil
+}
+
+// selectCollectable returns images which can be collected from the oldest, as well as the reasons of images kept
+func selectCollectable(images []api.Image, inUse map[string]bool, options GCOptions,
+	now time.Time) ([]api.Image, map[string]string) {
+	kept := map[string]string{}
+	var candidates []api.Image
+	for _, image := range images {
+		switch {
+		case len(image.Aliases) != 0:
+			kept[image.Fingerprint] = GC_REASON_ALIASED
+		case image.Cached:
+			// remote images cached by lxd are expired by lxd itself
+			kept[image.Fingerprint] = GC_REASON_CACHED
+		case inUse[image.Fingerprint]:
+			kept[image.Fingerprint] = GC_REASON_IN_USE
+		default:
+			candidates = append(candidates, image)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].UploadedAt.After(candidates[j].UploadedAt)
+	})
+	var collectable []api.Image
+	for i, image := range candidates {
+		lastUsed := image.UploadedAt
+		if image.LastUsedAt.After(lastUsed) {
+			lastUsed = image.LastUsedAt
+		}
+		switch {
+		case i < options.KeepLast:
+			kept[image.Fingerprint] = GC_REASON_KEEP
+		case now.Sub(lastUsed) < options.MinAge:
+			kept[image.Fingerprint] = GC_REASON_TOO_NEW
+		default:
+			collectable = append(collectable, image)
+		}
+	}
+	// collect from the oldest
+	for i, j := 0, len(collectable)-1; i < j; i, j = i+1, j-1 {
+		collectable[i], collectable[j] = collectable[j], collectable[i]
+	}
+	return collectable, kept
+}
+
+// collectImages deletes lxd images which are not aliased, cached by lxd nor used by instances according to
+// gc policy.
+func (h *Handler) collectImages() {
+	if h.lxdClient == nil {
+		return
+	}
+	images, err := h.lxdClient.GetImages()
+	if err != nil {
+		h.logger.Warn(fmt.Sprintf("unable to list images for gc, %s", err))
+		return
+	}
+	inUse, err := h.lxdClient.GetBaseImages()
+	if err != nil {
+		h.logger.Warn(fmt.Sprintf("unable to list images used by instances for gc, %s", err))
+		return
+	}
+	collectable, kept := selectCollectable(images, inUse, h.gc, time.Now())
+	for fingerprint, reason := range kept {
+		h.logger.Debug(fmt.Sprintf("image gc keeps image %s, %s", fingerprint, reason))
+	}
+	if len(collectable) == 0 {
+		return
+	}
+	if h.gc.HighWaterMark != 0 {
+		usage, err := h.poolUsage()
+		if err != nil {
+			h.logger.Warn(fmt.Sprintf("unable to get usage of storage pool %s, %s", h.gc.StoragePool, err))
+			return
+		}
+		if usage < h.gc.HighWaterMark && !h.gc.DryRun {
+			h.logger.Info(fmt.Sprintf("usage of storage pool %s %.1f%% below high water mark %.1f%%, %d "+
+				"collectable images kept", h.gc.StoragePool, usage, h.gc.HighWaterMark, len(collectable)))
+			return
+		}
+		h.logger.Info(fmt.Sprintf("usage of storage pool %s is %.1f%%, high water mark %.1f%%",
+			h.gc.StoragePool, usage, h.gc.HighWaterMark))
+	}
+	deleted := 0
+	for _, image := range collectable {
+		if h.gc.DryRun {
+			h.logger.Info(fmt.Sprintf("[dry run] image %s(%s, %d bytes, uploaded at %s) would be deleted",
+				image.Fingerprint, image.Type, image.Size, image.UploadedAt.Format(time.RFC3339)))
+			continue
+		}
+		if err = h.lxdClient.DeleteImageAndWait(image.Fingerprint); err != nil {
+			h.logger.Warn(fmt.Sprintf("failed to delete image %s, %s", image.Fingerprint, err))
+			continue
+		}
+		deleted += 1
+		h.logger.Info(fmt.Sprintf("image %s(%s, %d bytes, uploaded at %s) deleted", image.Fingerprint,
+			image.Type, image.Size, image.UploadedAt.Format(time.RFC3339)))
+		if h.gc.HighWaterMark != 0 {
+			if usage, err := h.poolUsage(); err == nil && usage < h.gc.HighWaterMark {
+				break
+			}
+		}
+	}
+	if h.gc.DryRun {
+		h.logger.Info(fmt.Sprintf("[dry run] image gc would delete %d images, %d images kept", len(collectable),
+			len(kept)))
+		return
+	}
+	h.logger.Info(fmt.Sprintf("image gc deleted %d images, %d images kept", deleted, len(kept)))
+}
+
+// poolUsage returns usage percentage of storage pool
+func (h *Handler) poolUsage() (float64, error) {
+	used, total, err := h.lxdClient.GetPoolUsage(h.gc.StoragePool)
+	if err != nil {
+		return 0, err
+	}
+	if total == 0 {
+		return 0, errors.New("total space unknown")
+	}
+	return float64(used) * 100 / float64(total), nil
+}
@@ -2,65 +2,106 @@ package image
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"go.uber.org/zap"
 	"lxc-launcher/lxd"
 	"net/http"
-	"net/url"
-	"strings"
+	"sync"
 	"time"
 )
 
-const (
-	SWR    = "swr"
-	DOCKER = "docker"
-)
-
 //var loadLock sync.Mutex
 
 type Handler struct {
 	baseFolder   string
-	metaEndpoint string
+	source       ImageSource
 	worker       int64
 	syncInterval int64
 	imageCh      chan ImageDetail
 	closeCh      chan bool
 	logger       *zap.Logger
-	user         string
-	password     string
+	options      RegistryOptions
 	lxdClient    *lxd.Client
+	blobStore    *BlobStore
+	convert      ConvertOptions
+	gc           GCOptions
+	verifier     *SignatureVerifier
+	progress     *ProgressTracker
+	// versions retained for images which keep previous versions
+	retain int64
+	// notified when image list changed in watched source
+	changeCh chan bool
+	mutex    sync.Mutex
+	// images queued or being synced, keyed by image reference
+	pending map[string]bool
+	// serializes syncs of the same image
+	locks *keyLocks
+	state *StateStore
+	// syncs image picked up by workers
+	syncFunc func(ctx context.Context, detail ImageDetail) error
 }
 
-type LXDImageResponse struct {
-	Images []ImageDetail `json:"images"`
-}
-
-type LXDImageList struct {
-	Images []string `json:"images"`
-}
-
+// ImageDetail is the image declared in metadata endpoint
 type ImageDetail struct {
+	// registry reference of image
 	Name string `json:"name"`
+	// instance type of image, it's inferred from name or image content when empty
 	Type string `json:"type"`
+	// lxd alias of image, the last component of repository is used when empty
+	Alias string `json:"alias"`
+	// architecture of platform selected from image index, lxd host architecture is used when empty
+	Architecture string `json:"architecture"`
+	// image is pulled by the pinned digest rather than tag when specified
+	Digest string `json:"digest"`
+	// images with higher priority are synced first
+	Priority int `json:"priority"`
+	// whether to keep previous versions for rollback, only the current version is kept otherwise
+	KeepPrevious bool `json:"keepPrevious"`
 }
 
-func NewImageHandler(username, password, baseFolder, metaEndpoint string, worker int64,
-	syncInterval int64, lxdClient *lxd.Client, logger *zap.Logger) (*Handler, error) {
-
-	return &Handler{
-		user:         username,
-		password:     password,
+// NewImageHandler creates image handler, source can be nil when images are not synced from image list
+func NewImageHandler(options RegistryOptions, convert ConvertOptions, gc GCOptions, publicKeys []string, source ImageSource,
+	baseFolder string, worker int64, syncInterval int64, retain int64, lxdClient *lxd.Client, logger *zap.Logger) (*Handler, error) {
+	if err := convert.Validate(); err != nil {
+		return nil, err
+	}
+	if err := gc.Validate(); err != nil {
+		return nil, err
+	}
+	verifier, err := NewSignatureVerifier(publicKeys)
+	if err != nil {
+		return nil, err
+	}
+	blobStore, err := NewBlobStore(baseFolder, logger)
+	if err != nil {
+		return nil, err
+	}
+	// bandwidth limit is shared by all workers
+	options.limiter = NewRateLimiter(options.RateLimit)
+	h := &Handler{
+		options:      options,
 		baseFolder:   baseFolder,
-		metaEndpoint: metaEndpoint,
+		source:       source,
+		changeCh:     make(chan bool, 1),
 		worker:       worker,
 		syncInterval: syncInterval,
 		imageCh:      make(chan ImageDetail, worker*32),
 		closeCh:      make(chan bool, 1),
 		lxdClient:    lxdClient,
 		logger:       logger,
-	}, nil
+		blobStore:    blobStore,
+		convert:      convert,
+		gc:           gc,
+		verifier:     verifier,
+		progress:     NewProgressTracker(),
+		retain:       retain,
+		pending:      map[string]bool{},
+		locks:        newKeyLocks(),
+		state:        NewStateStore(baseFolder, logger),
+	}
+	h.syncFunc = h.syncImage
+	return h, nil
 }
 
 func (h *Handler) StartLoop() {
@@ -70,13 +111,23 @@ func (h *Handler) StartLoop() {
 		h.logger.Warn(fmt.Sprintf("unable to list image details %s", err))
 		return
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
 	for i := 1; i <= int(h.worker); i++ {
 		h.logger.Info(fmt.Sprintf("starting to initialzie worker %d to load image.", i))
-		go h.pullingImage(i, h.closeCh)
+		wg.Add(1)
+		go h.pullingImage(ctx, i, &wg)
 	}
+	go h.source.Watch(ctx, h.notifyChange)
 	ticker := time.NewTicker(time.Duration(h.syncInterval) * time.Second)
 	for {
 		select {
+		case <-h.changeCh:
+			h.logger.Info("image list changed, start to sync images")
+			if err := h.pushImageLoadTask(); err != nil {
+				h.logger.Warn(fmt.Sprintf("unable to list image details %s", err))
+			}
 		case <-ticker.C:
 			err := h.pushImageLoadTask()
 			if err != nil {
@@ -89,16 +140,28 @@ func (h *Handler) StartLoop() {
 					fmt.Println("delErr: ", delErr)
 				}
 			}
+			h.collectImages()
+			h.collectBlobs()
 		case _, ok := <-h.closeCh:
 			if !ok {
 				h.logger.Info("image handler received close event, quiting..")
-				time.Sleep(5 * time.Second)
+				// pulls in progress are canceled
+				cancel()
+				wg.Wait()
 				return
 			}
 		}
 	}
 }
 
+// notifyChange triggers sync of images, it doesn't block if sync already triggered
+func (h *Handler) notifyChange() {
+	select {
+	case h.changeCh <- true:
+	default:
+	}
+}
+
 func (h *Handler) FakeLoop() {
 	ticker := time.NewTicker(time.Duration(h.syncInterval) * time.Second)
 	for {
@@ -114,56 +177,185 @@ func (h *Handler) FakeLoop() {
 	}
 }
 
+// ProgressHandler serves pull progress of images in json
+func (h *Handler) ProgressHandler(w http.ResponseWriter, req *http.Request) {
+	h.progress.Handler(w, req)
+}
+
+// StateHandler serves sync state of images in json
+func (h *Handler) StateHandler(w http.ResponseWriter, req *http.Request) {
+	h.state.Handler(w, req)
+}
+
 func (h *Handler) Close() {
 	close(h.closeCh)
 }
 
 func (h *Handler) GetImagePuller(detail ImageDetail) (*Puller, error) {
-	if strings.ToLower(detail.Type) == DOCKER {
-		return NewDockerIOV2ImagePuller(h.user, h.password, h.baseFolder, detail.Name, h.logger, h.lxdClient)
-	} else if strings.ToLower(detail.Type) == SWR {
-		nameIdentities := strings.SplitN(detail.Name, "/", 2)
-		if len(nameIdentities) != 2 {
-			return nil, errors.New(fmt.Sprintf("incorrect SWR image name %s found", detail.Name))
+	options := h.options
+	// auth file is loaded for each image so that rotated credentials are picked up
+	if len(options.AuthFile) != 0 {
+		config, err := LoadDockerConfig(options.AuthFile)
+		if err != nil {
+			return nil, err
 		}
-		return NewSWRV2ImagePuller(h.user, h.password, h.baseFolder, nameIdentities[0], nameIdentities[1], h.logger, h.lxdClient)
+		options.dockerConfig = config
 	}
-	return nil, errors.New(fmt.Sprintf("unsupported docker image type %s found", detail.Type))
+	name, err := detail.FullName()
+	if err != nil {
+		return nil, err
+	}
+	puller, err := NewImagePuller(options, h.blobStore, h.baseFolder, name, h.logger, h.lxdClient)
+	if err != nil {
+		return nil, err
+	}
+	puller.alias = detail.Alias
+	puller.instanceType = detail.Type
+	if detail.KeepPrevious {
+		puller.retain = int(h.retain)
+	}
+	if len(detail.Architecture) != 0 {
+		puller.architecture, puller.variant = platformFromArchitecture(detail.Architecture)
+	}
+	puller.convertOptions = h.convert
+	puller.signatureVerifier = h.verifier
+	puller.progress = h.progress
+	return puller, nil
 }
 
-func (h *Handler) pullingImage(index int, closeCh chan bool) {
-	ctx, cancel := context.WithCancel(context.Background())
-	readyCh := make(chan bool, 1)
-	readyCh <- true
-	canceled := false
+// collectBlobs removes blobs which are not referenced by any image folder
+func (h *Handler) collectBlobs() {
+	referenced, err := ReferencedBlobs(h.baseFolder)
+	if err != nil {
+		h.logger.Warn(fmt.Sprintf("unable to collect referenced blobs, %s", err))
+		return
+	}
+	removed, err := h.blobStore.GarbageCollect(referenced)
+	if err != nil {
+		h.logger.Warn(fmt.Sprintf("failed to collect unreferenced blobs, %s", err))
+	}
+	if removed != 0 {
+		h.logger.Info(fmt.Sprintf("%d unreferenced blobs removed", removed))
+	}
+}
+
+func (h *Handler) pullingImage(ctx context.Context, index int, wg *sync.WaitGroup) {
+	defer wg.Done()
 	for {
-		if canceled {
-			return
-		}
 		select {
-		case _, ok := <-closeCh:
-			if !ok {
-				h.logger.Info(fmt.Sprintf("close channel received, will quit load image for worker %d",
-					index))
-				cancel()
-				canceled = true
-				time.Sleep(time.Second * 5)
+		case <-ctx.Done():
+			h.logger.Info(fmt.Sprintf("close channel received, will quit load image for worker %d", index))
+			return
+		case detail := <-h.imageCh:
+			// image may be picked up along with close event, it's left to the next start
+			if ctx.Err() != nil {
+				h.done(detail)
+				h.logger.Info(fmt.Sprintf("close channel received, will quit load image for worker %d", index))
+				return
 			}
-		case <-readyCh:
-			i := <-h.imageCh
-			//loadLock.Lock()
-			h.logger.Info(fmt.Sprintf("start to download image %s", i.Name))
-			puller, err := h.GetImagePuller(i)
-			if err != nil {
-				//loadLock.Unlock()
-				h.logger.Error(err.Error())
-				readyCh <- true
-				continue
+			h.logger.Info(fmt.Sprintf("worker %d start to download image %s", index, detail.Name))
+			if err := h.syncFunc(ctx, detail); err != nil {
+				h.logger.Error(fmt.Sprintf("failed to sync image %s, %s", detail.Name, err))
 			}
-			puller.DownloadImage(ctx, readyCh)
-			//loadLock.Unlock()
+			h.done(detail)
+		}
+	}
+}
+
+// syncImage pulls image while holding the lock of image, so that the same image is never synced concurrently
+// even if it's declared by different names.
+func (h *Handler) syncImage(ctx context.Context, detail ImageDetail) error {
+	puller, err := h.GetImagePuller(detail)
+	if err == nil {
+		var unlock func()
+		if unlock, err = h.lock(ctx, puller); err == nil {
+			err = puller.Pull(ctx)
+			unlock()
 		}
 	}
+	h.recordState(ctx, detail, puller, err)
+	return err
+}
+
+// PullImage pulls image into lxd on demand outside of sync loop, it's skipped if image alias is loaded by others
+// while waiting for the image lock.
+func (h *Handler) PullImage(ctx context.Context, detail ImageDetail) error {
+	puller, err := h.GetImagePuller(detail)
+	if err != nil {
+		return err
+	}
+	unlock, err := h.lock(ctx, puller)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if len(detail.Alias) != 0 {
+		exists, err := h.lxdClient.CheckImageByAlias(detail.Alias)
+		if err != nil {
+			return err
+		}
+		if exists {
+			h.logger.Info(fmt.Sprintf("image %s already loaded as %s, skip pulling", detail.Name, detail.Alias))
+			return nil
+		}
+	}
+	return puller.Pull(ctx)
+}
+
+// lock takes the lock of image in process and then the lock file on node, the returned function releases both
+func (h *Handler) lock(ctx context.Context, puller *Puller) (func(), error) {
+	unlock := h.locks.Lock(puller.reference.String())
+	unlockFile, err := LockImage(ctx, h.baseFolder, puller.reference.String())
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile()
+		unlock()
+	}, nil
+}
+
+// recordState records result of image sync in state file, syncs canceled on exit are not recorded
+func (h *Handler) recordState(ctx context.Context, detail ImageDetail, puller *Puller, syncErr error) {
+	var err error
+	switch {
+	case syncErr == nil:
+		err = h.state.Succeed(detail, puller.alias, puller.imageDigest, puller.fingerprint)
+	case ctx.Err() != nil:
+		return
+	default:
+		err = h.state.Fail(detail, syncErr)
+	}
+	if err != nil {
+		h.logger.Warn(fmt.Sprintf("unable to record sync state of image %s, %s", detail.Name, err))
+	}
+}
+
+// enqueue queues image for syncing, false is returned if it's already queued or being synced, and error is
+// returned when queue is full.
+func (h *Handler) enqueue(detail ImageDetail) (bool, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := detail.key()
+	if h.pending[key] {
+		return false, nil
+	}
+	select {
+	case h.imageCh <- detail:
+		h.pending[key] = true
+		return true, nil
+	default:
+		return false, errors.New(fmt.Sprintf("too many jobs [%d/%d] need to be finished", len(h.imageCh),
+			cap(h.imageCh)))
+	}
+}
+
+// done marks image as synced, it can be queued again afterwards
+func (h *Handler) done(detail ImageDetail) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.pending, detail.key())
 }
 
 func (h *Handler) pushImageLoadTask() error {
@@ -172,65 +364,35 @@ func (h *Handler) pushImageLoadTask() error {
 		h.logger.Error(fmt.Sprintln("h.retrieveImages, err: ", err))
 		return err
 	}
-	if len(h.imageCh)+len(images) > cap(h.imageCh) {
-		h.logger.Warn(fmt.Sprintf("still have too many jobs [%d/%d] need to be finished, skip new arrangement",
-			len(h.imageCh), cap(h.imageCh)))
-		return nil
+	if err = h.state.Declare(images); err != nil {
+		h.logger.Warn(fmt.Sprintf("unable to record sync state of image list, %s", err))
 	}
-	h.logger.Info(fmt.Sprintf("new image load tasks arranged, current jobs are [%d/%d]",
-		len(h.imageCh)+len(images), cap(h.imageCh)))
+	queued, skipped := 0, 0
 	for _, image := range images {
-		h.imageCh <- image
+		ok, err := h.enqueue(image)
+		if err != nil {
+			h.logger.Warn(fmt.Sprintf("skip new arrangement of image %s, %s", image.Name, err))
+			continue
+		}
+		if !ok {
+			skipped += 1
+			continue
+		}
+		queued += 1
 	}
+	h.logger.Info(fmt.Sprintf("new image load tasks arranged, %d queued, %d skipped since in progress, "+
+		"current jobs are [%d/%d]", queued, skipped, len(h.imageCh), cap(h.imageCh)))
 	return nil
 }
 
 func (h *Handler) retrieveImages() ([]ImageDetail, error) {
-	reqUrl, err := url.Parse(h.metaEndpoint)
-	if err != nil {
-		h.logger.Error(fmt.Sprintln("h.metaEndpoint: ", h.metaEndpoint, ", err: ", err))
-		return []ImageDetail{}, err
+	if h.source == nil {
+		return []ImageDetail{}, errors.New("image source not specified")
 	}
-	req, err := http.NewRequest("GET", reqUrl.String(), nil)
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*10)
-	req.WithContext(ctx)
+	images, err := h.source.Images(context.Background())
 	if err != nil {
-		h.logger.Error(fmt.Sprintln("reqUrl: ", reqUrl.String(), ", err: ", err))
 		return []ImageDetail{}, err
 	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		h.logger.Error(fmt.Sprintln("resp: ", resp, ", err: ", err))
-		return []ImageDetail{}, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		h.logger.Error(fmt.Sprintln("resp.StatusCode: ", resp.StatusCode, ", err: ", err))
-		return []ImageDetail{}, errors.New(fmt.Sprintf("request %s response code incorrect expected %d got %d",
-			reqUrl.String(), http.StatusOK, resp.StatusCode))
-	}
-	decoder := json.NewDecoder(resp.Body)
-	var imageResponse LXDImageResponse
-	var imageList LXDImageList
-	imageReList := make([]ImageDetail, 0)
-	if err = decoder.Decode(&imageList); err != nil {
-		h.logger.Error(fmt.Sprintln("decoder.Decode(&imageResponse), err: ", err))
-		return []ImageDetail{}, errors.New(fmt.Sprintf(
-			"failed to get image meta info from api response: %s", err))
-	}
-	if len(imageList.Images) > 0 {
-		for _, image := range imageList.Images {
-			imageDetail := ImageDetail{}
-			imageDetail.Name = image
-			if strings.Contains(image, SWR) {
-				imageDetail.Type = SWR
-			} else {
-				imageDetail.Type = DOCKER
-			}
-			imageReList = append(imageReList, imageDetail)
-		}
-		imageResponse.Images = imageReList
-	}
-	h.logger.Info(fmt.Sprintln("imageResponse.Images: ", imageResponse.Images))
-	return imageResponse.Images, nil
+	h.logger.Info(fmt.Sprintln("images: ", images))
+	return images, nil
 }
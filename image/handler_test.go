@@ -0,0 +1,204 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const testTimeout = 10 * time.Second
+
+// staticSource serves a fixed image list and never notifies changes
+type staticSource struct {
+	images []ImageDetail
+}
+
+func (s *staticSource) Images(ctx context.Context) ([]ImageDetail, error) {
+	return s.images, nil
+}
+
+func (s *staticSource) Watch(ctx context.Context, notify func()) {
+	<-ctx.Done()
+}
+
+func newTestHandler(t *testing.T, worker int64, images []ImageDetail) *Handler {
+	folder, err := ioutil.TempDir("", "handler-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(folder)
+	})
+	h, err := NewImageHandler(RegistryOptions{}, ConvertOptions{}, GCOptions{}, nil, &staticSource{images: images},
+		folder, worker, 3600, 1, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testImages(count int) []ImageDetail {
+	images := make([]ImageDetail, 0, count)
+	for i := 0; i < count; i++ {
+		images = append(images, ImageDetail{Name: fmt.Sprintf("registry.example.com/library/image-%d:latest", i)})
+	}
+	return images
+}
+
+// startHandler runs sync loop of handler, the returned channel is closed once the loop quits
+func startHandler(h *Handler) chan bool {
+	stopped := make(chan bool)
+	go func() {
+		h.StartLoop()
+		close(stopped)
+	}()
+	return stopped
+}
+
+func TestHandlerDeduplicatesPendingImages(t *testing.T) {
+	h := newTestHandler(t, 1, nil)
+	detail := ImageDetail{Name: "ubuntu:20.04", Alias: "ubuntu"}
+	cases := []struct {
+		name   string
+		detail ImageDetail
+		queued bool
+	}{
+		{name: "new image", detail: detail, queued: true},
+		{name: "pending image", detail: detail, queued: false},
+		{name: "same reference with full name", detail: ImageDetail{Name: "docker.io/library/ubuntu:20.04", Alias: "ubuntu"}, queued: false},
+		{name: "same reference with different alias", detail: ImageDetail{Name: "ubuntu:20.04", Alias: "focal"}, queued: true},
+		{name: "same reference with different type", detail: ImageDetail{Name: "ubuntu:20.04", Alias: "ubuntu", Type: VM}, queued: true},
+	}
+	for _, c := range cases {
+		queued, err := h.enqueue(c.detail)
+		if err != nil {
+			t.Fatalf("%s: unexpected error %s", c.name, err)
+		}
+		if queued != c.queued {
+			t.Fatalf("%s: expected queued %t got %t", c.name, c.queued, queued)
+		}
+	}
+	h.done(detail)
+	if queued, err := h.enqueue(detail); err != nil || !queued {
+		t.Fatalf("image synced should be queued again, got %t and %v", queued, err)
+	}
+}
+
+func TestHandlerRejectsWhenQueueFull(t *testing.T) {
+	h := newTestHandler(t, 1, nil)
+	images := testImages(cap(h.imageCh) + 1)
+	for _, image := range images[:cap(h.imageCh)] {
+		if _, err := h.enqueue(image); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+	}
+	last := images[cap(h.imageCh)]
+	if _, err := h.enqueue(last); err == nil {
+		t.Fatal("expected error when queue is full")
+	}
+	// rejected image isn't regarded as pending
+	h.mutex.Lock()
+	pending := h.pending[last.key()]
+	h.mutex.Unlock()
+	if pending {
+		t.Fatal("rejected image should not be pending")
+	}
+}
+
+func TestHandlerLimitsConcurrentSyncs(t *testing.T) {
+	const worker = 2
+	images := testImages(6)
+	h := newTestHandler(t, worker, images)
+	started := make(chan string, len(images))
+	release := make(chan bool)
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	h.syncFunc = func(ctx context.Context, detail ImageDetail) error {
+		mutex.Lock()
+		running += 1
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		started <- detail.Name
+		<-release
+		mutex.Lock()
+		running -= 1
+		mutex.Unlock()
+		return nil
+	}
+	stopped := startHandler(h)
+	for i := 0; i < worker; i++ {
+		select {
+		case <-started:
+		case <-time.After(testTimeout):
+			t.Fatalf("only %d of %d workers started syncing", i, worker)
+		}
+	}
+	select {
+	case name := <-started:
+		t.Fatalf("image %s synced while all %d workers are busy", name, worker)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	for i := worker; i < len(images); i++ {
+		select {
+		case <-started:
+		case <-time.After(testTimeout):
+			t.Fatalf("only %d of %d images synced", i, len(images))
+		}
+	}
+	h.Close()
+	<-stopped
+	mutex.Lock()
+	defer mutex.Unlock()
+	if maxRunning != worker {
+		t.Fatalf("expected at most %d concurrent syncs got %d", worker, maxRunning)
+	}
+	if len(h.pending) != 0 {
+		t.Fatalf("expected no pending images after syncs got %d", len(h.pending))
+	}
+}
+
+func TestHandlerShutdownCancelsSyncs(t *testing.T) {
+	images := testImages(3)
+	h := newTestHandler(t, 1, images)
+	started := make(chan bool, len(images))
+	canceled := make(chan error, len(images))
+	h.syncFunc = func(ctx context.Context, detail ImageDetail) error {
+		started <- true
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return ctx.Err()
+	}
+	stopped := startHandler(h)
+	select {
+	case <-started:
+	case <-time.After(testTimeout):
+		t.Fatal("image sync not started")
+	}
+	h.Close()
+	select {
+	case <-stopped:
+	case <-time.After(testTimeout):
+		t.Fatal("handler not stopped after closed")
+	}
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Fatalf("expected sync canceled got %v", err)
+		}
+	default:
+		t.Fatal("sync in progress not canceled before handler stopped")
+	}
+	// workers quit without picking up the rest of images
+	if len(started) != 0 {
+		t.Fatalf("expected no more syncs after close got %d", len(started))
+	}
+}
@@ -1,6 +1,8 @@
 package image
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	cli "github.com/lxc/lxd/client"
 	"github.com/lxc/lxd/shared/api"
@@ -19,12 +21,12 @@ const (
 	COMPRESS_TYPE  = "gzip"
 )
 
-func (p *Puller) loadLXDImages() error {
+func (p *Puller) loadLXDImages(ctx context.Context) error {
 	p.logger.Info(fmt.Sprintln("import image start...."))
-	imagePathList := strings.Split(p.imageName, "/")
-	imageAliaName := imagePathList[len(imagePathList)-1]
+	imageAliaName := p.aliasName()
+	p.alias = imageAliaName
 	// import images
-	imImageErr := p.ImportLxdImages(imageAliaName)
+	imImageErr := p.ImportLxdImages(ctx, imageAliaName)
 	if imImageErr != nil {
 		p.logger.Error(fmt.Sprintln("imImageErr: ", imImageErr))
 		return imImageErr
@@ -32,37 +34,105 @@ func (p *Puller) loadLXDImages() error {
 	return nil
 }
 
-func (p *Puller) ImportLxdImages(imageAliaName string) error {
-	imageApi := api.ImagesPost{}
-	imageType := api.InstanceType(VM)
-	fileType := VM_TYPE
-	if strings.Contains(p.imageName, CONTAINER) {
-		imageType = api.InstanceType(CONTAINER)
-		fileType = CONTAINER_TYPE
+// aliasName returns alias of image, the last component of repository is used when alias not specified
+func (p *Puller) aliasName() string {
+	if len(p.alias) != 0 {
+		return p.alias
+	}
+	imagePathList := strings.Split(p.imageName, "/")
+	return imagePathList[len(imagePathList)-1]
+}
+
+// loadedVersion returns fingerprint of the version loaded from digest, empty fingerprint is returned when the
+// version isn't loaded or alias is removed. Loaded versions are not loaded again so that alias rolled back is
+// kept until digest changes.
+func (p *Puller) loadedVersion(digest string) (string, error) {
+	entries, err := p.lxdClient.GetImageAliases()
+	if err != nil {
+		return "", err
 	}
-	imageArgs := cli.ImageCreateArgs{Type: string(imageType)}
+	alias := p.aliasName()
+	versionAlias := VersionAlias(alias, digest)
+	aliasFound, fingerprint := false, ""
+	for _, entry := range entries {
+		switch entry.Name {
+		case alias:
+			aliasFound = true
+		case versionAlias:
+			fingerprint = entry.Target
+		}
+	}
+	if !aliasFound {
+		return "", nil
+	}
+	return fingerprint, nil
+}
+
+func (p *Puller) ImportLxdImages(ctx context.Context, imageAliaName string) error {
+	imageType, fileType := p.imageType()
+	metaFile, rootfsFile := "", ""
 	for _, fileName := range p.FileNameList {
 		baseName := filepath.Base(fileName)
 		if strings.Contains(baseName, fileType) {
-			fr, readErr := os.Open(fileName)
-			if readErr != nil {
-				p.logger.Info(fmt.Sprintf("%s, readErr: %s", fileType, readErr))
-				return readErr
-			}
-			imageArgs.RootfsFile = fr
-			imageArgs.RootfsName = fileName
+			rootfsFile = fileName
+		}
+		if strings.Contains(baseName, LXD_TYPE) || baseName == METADATA_IMAGE || baseName == UNIFIED_IMAGE {
+			metaFile = fileName
 		}
+	}
+	if len(metaFile) == 0 {
+		return errors.New(fmt.Sprintf("metadata of %s image %s not found", imageType, p.imageName))
+	}
+	return p.createImage(ctx, imageType, imageAliaName, metaFile, rootfsFile)
+}
 
-		if strings.Contains(baseName, LXD_TYPE) {
-			fr, readErr := os.Open(fileName)
-			if readErr != nil {
-				p.logger.Info(fmt.Sprintf("%s, readErr: %s", LXD_TYPE, readErr))
-				return readErr
+// imageType returns lxd instance type of image and the rootfs file type, the type is inferred from image files
+// and then image name when not specified. Converted images are always container images.
+func (p *Puller) imageType() (string, string) {
+	isContainer := p.instanceType == CONTAINER || p.converted
+	if len(p.instanceType) == 0 && !p.converted {
+		isContainer = strings.Contains(p.imageName, CONTAINER)
+		for _, fileName := range p.FileNameList {
+			baseName := filepath.Base(fileName)
+			if strings.Contains(baseName, CONTAINER_TYPE) || baseName == UNIFIED_IMAGE {
+				isContainer = true
+				break
+			}
+			if strings.Contains(baseName, VM_TYPE) {
+				isContainer = false
+				break
 			}
-			imageArgs.MetaFile = fr
-			imageArgs.MetaName = fileName
 		}
 	}
+	if isContainer {
+		return CONTAINER, CONTAINER_TYPE
+	}
+	return VM, VM_TYPE
+}
+
+// createImage creates lxd image from metadata file and rootfs file and points alias to it, rootfs file is empty
+// for unified images.
+func (p *Puller) createImage(ctx context.Context, imageType, imageAliaName, metaFile, rootfsFile string) error {
+	imageApi := api.ImagesPost{}
+	imageArgs := cli.ImageCreateArgs{Type: imageType}
+	fr, readErr := os.Open(metaFile)
+	if readErr != nil {
+		p.logger.Info(fmt.Sprintf("%s, readErr: %s", LXD_TYPE, readErr))
+		return readErr
+	}
+	defer fr.Close()
+	imageArgs.MetaFile = fr
+	imageArgs.MetaName = metaFile
+	if len(rootfsFile) != 0 {
+		fr, readErr := os.Open(rootfsFile)
+		if readErr != nil {
+			p.logger.Info(fmt.Sprintf("%s, readErr: %s", rootfsFile, readErr))
+			return readErr
+		}
+		defer fr.Close()
+		imageArgs.RootfsFile = fr
+		imageArgs.RootfsName = rootfsFile
+	}
 	imageApi.Filename = imageAliaName
 	imageApi.ImagePut.Public = true
 	imageApi.CompressionAlgorithm = COMPRESS_TYPE
@@ -74,7 +144,7 @@ func (p *Puller) ImportLxdImages(imageAliaName string) error {
 		return creteImageErr
 	}
 	p.logger.Info(fmt.Sprintln("The image is imported successfully, ", op))
-	imAliasErr := p.ImportLxdImageAlias(op, string(imageType), imageAliaName)
+	imAliasErr := p.ImportLxdImageAlias(ctx, op, imageType, imageAliaName)
 	if imAliasErr != nil {
 		p.logger.Error(fmt.Sprintln("imAliasErr: ", imAliasErr))
 		return imAliasErr
@@ -82,16 +152,14 @@ func (p *Puller) ImportLxdImages(imageAliaName string) error {
 	return nil
 }
 
-func (p *Puller) ImportLxdImageAlias(op cli.Operation, imageType, imageAliaName string) error {
+// ImportLxdImageAlias waits for fingerprint of image created and points alias to it, waiting ends when ctx done
+func (p *Puller) ImportLxdImageAlias(ctx context.Context, op cli.Operation, imageType, imageAliaName string) error {
 	// Create image alias
 	alias := api.ImageAliasesPost{}
 	alias.Type = imageType
 	alias.Name = imageAliaName
 	alias.Description = imageAliaName
 	opValue := op.Get()
-	p.logger.Info(fmt.Sprintln("opValue.Resources: ", opValue.Resources, ",opValue.Metadata: ", opValue.Metadata,
-		",opValue.Status:", opValue.Status, ",opValue.StatusCode: ", opValue.StatusCode,
-		",opValue.Location: ", opValue.Location, ",opValue.Description： ", opValue.Description, ",opValue.ID: ", opValue.ID))
 	for {
 		getOp, _, opErr := p.lxdClient.GetOperation(opValue.ID)
 		if opErr != nil {
@@ -100,6 +168,11 @@ func (p *Puller) ImportLxdImageAlias(op cli.Operation, imageType, imageAliaName
 		if len(getOp.Metadata) > 0 {
 			if fingerPrint, ok := getOp.Metadata["fingerprint"]; ok {
 				alias.Target = fingerPrint.(string)
+				p.fingerprint = alias.Target
+				if err := p.createVersionAlias(imageType, imageAliaName, alias.Target); err != nil {
+					p.logger.Error(fmt.Sprintf("failed to create version alias of image %s, %s", imageAliaName, err))
+					return err
+				}
 				delAliasErr := p.DeleteImageAlias(imageAliaName)
 				if delAliasErr != nil {
 					p.logger.Error(fmt.Sprintln("delAliasErr:", delAliasErr))
@@ -111,18 +184,56 @@ func (p *Puller) ImportLxdImageAlias(op cli.Operation, imageType, imageAliaName
 					return aliasErr
 				} else {
 					p.logger.Info(fmt.Sprintln("Create image alias successfully, ", alias, ",getOp.ID:", getOp.ID))
+					if err := PruneImageVersions(p.lxdClient, imageAliaName, p.retain, p.logger); err != nil {
+						p.logger.Warn(fmt.Sprintf("unable to prune versions of image %s, %s", imageAliaName, err))
+					}
 					break
 				}
-			} else {
-				time.Sleep(1 * time.Second)
 			}
-		} else {
-			time.Sleep(1 * time.Second)
+		}
+		// operation finished without fingerprint never gets one
+		if getOp.StatusCode.IsFinal() {
+			if len(getOp.Err) != 0 {
+				return errors.New(fmt.Sprintf("failed to create image %s, %s", imageAliaName, getOp.Err))
+			}
+			return errors.New(fmt.Sprintf("image %s created without fingerprint, operation %s is %s",
+				imageAliaName, getOp.ID, getOp.Status))
+		}
+		select {
+		case <-ctx.Done():
+			return errors.New(fmt.Sprintf("waiting for fingerprint of image %s canceled, %s", imageAliaName, ctx.Err()))
+		case <-time.After(time.Second):
 		}
 	}
 	return nil
 }
 
+// createVersionAlias points versioned alias <alias>@<digest-short> to the image with fingerprint, so that the
+// image is kept for rollback after alias moved to newer versions.
+func (p *Puller) createVersionAlias(imageType, imageAliaName, fingerprint string) error {
+	digest := p.imageDigest
+	if len(digest) == 0 {
+		digest = p.manifestDigest
+	}
+	if len(digest) == 0 {
+		digest = fingerprint
+	}
+	versionAlias := VersionAlias(imageAliaName, digest)
+	if err := p.DeleteImageAlias(versionAlias); err != nil {
+		return err
+	}
+	version := api.ImageAliasesPost{}
+	version.Type = imageType
+	version.Name = versionAlias
+	version.Description = fmt.Sprintf("%s of digest %s", imageAliaName, digest)
+	version.Target = fingerprint
+	if err := p.lxdClient.CreateImageAlias(version); err != nil {
+		return err
+	}
+	p.logger.Info(fmt.Sprintf("image %s kept as version %s", fingerprint, versionAlias))
+	return nil
+}
+
 func (p *Puller) DeleteImageAlias(imageAliaName string) error {
 	imageExists, _ := p.lxdClient.CheckManageImageByAlias(imageAliaName)
 	if imageExists {
@@ -136,23 +247,3 @@ func (p *Puller) DeleteImageAlias(imageAliaName string) error {
 	}
 	return nil
 }
-
-func (p *Puller) DeleteInvalidImages() {
-	images, getErr := p.lxdClient.GetImages()
-	if getErr != nil {
-		p.logger.Error(fmt.Sprintf("getErr: %v", getErr))
-		return
-	}
-	if len(images) > 0 {
-		for _, image := range images {
-			if len(image.Aliases) == 0 && len(image.Fingerprint) > 0 {
-				op, opErr := p.lxdClient.DeleteImage(image.Fingerprint)
-				if opErr != nil {
-					p.logger.Error(fmt.Sprintf("p.lxdClient.DeleteImage, Failed to delete mirror, opErr: %v", opErr))
-				} else {
-					p.logger.Info(fmt.Sprintln("Mirror deleted successfully, op: ", op))
-				}
-			}
-		}
-	}
-}
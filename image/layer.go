@@ -0,0 +1,311 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	WHITEOUT_PREFIX = ".wh."
+	WHITEOUT_OPAQUE = ".wh..wh..opq"
+	// symlinks followed when resolving a path inside of rootfs, the same as linux MAXSYMLINKS * 6
+	MAX_SYMLINK_FOLLOWS = 255
+)
+
+// layerApplier applies OCI layer changesets onto rootfs from the lowest to the topmost layer, entry paths as well
+// as hardlink targets are resolved inside of rootfs so that layers can't write outside of it.
+type layerApplier struct {
+	root   string
+	logger *zap.Logger
+	// ownership is only applied when running as root
+	chown bool
+	// paths created by the layer being applied, they are kept when opaque whiteout found in the same layer
+	created map[string]bool
+}
+
+func newLayerApplier(root string, logger *zap.Logger) *layerApplier {
+	return &layerApplier{
+		root:   root,
+		logger: logger,
+		chown:  os.Geteuid() == 0,
+	}
+}
+
+// Apply applies the layer content which is either gzip compressed or plain tarball
+func (a *layerApplier) Apply(reader io.Reader, canceled func() bool) error {
+	bufReader := bufio.NewReader(reader)
+	var content io.Reader = bufReader
+	if magic, err := bufReader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gReader, err := gzip.NewReader(bufReader)
+		if err != nil {
+			return err
+		}
+		defer gReader.Close()
+		content = gReader
+	}
+	a.created = map[string]bool{}
+	// directory mtimes are restored at last since creating children updates them
+	dirTimes := map[string]time.Time{}
+	tr := tar.NewReader(content)
+	for {
+		if canceled() {
+			return errors.New("layer application canceled")
+		}
+		hdr, err := tr.Next()
+		switch {
+		case err == io.EOF:
+			for dir, mtime := range dirTimes {
+				// skip directories replaced by later entries, Chtimes follows symlinks
+				info, err := os.Lstat(dir)
+				if os.IsNotExist(err) || (err == nil && !info.IsDir()) {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				if err = os.Chtimes(dir, mtime, mtime); err != nil {
+					return err
+				}
+			}
+			return nil
+		case err != nil:
+			return err
+		case hdr == nil:
+			continue
+		}
+		if err = a.applyEntry(tr, hdr, dirTimes); err != nil {
+			return errors.New(fmt.Sprintf("failed to apply entry %s, %s", hdr.Name, err))
+		}
+	}
+}
+
+func (a *layerApplier) applyEntry(tr *tar.Reader, hdr *tar.Header, dirTimes map[string]time.Time) error {
+	name := path.Clean("/" + hdr.Name)
+	if name == "/" {
+		return nil
+	}
+	parentName, base := path.Split(name)
+	parent, err := a.resolve(parentName)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(parent, base)
+	if base == WHITEOUT_OPAQUE {
+		return a.removeChildren(parent, dirTimes)
+	}
+	if strings.HasPrefix(base, WHITEOUT_PREFIX) {
+		removed, err := a.whiteoutTarget(parent, strings.TrimPrefix(base, WHITEOUT_PREFIX))
+		if err != nil {
+			return err
+		}
+		forgetDirTimes(dirTimes, removed)
+		return os.RemoveAll(removed)
+	}
+	if err = os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(target); err == nil {
+		if !(info.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			forgetDirTimes(dirTimes, target)
+			if err = os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err = os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+		dirTimes[target] = hdr.ModTime
+	case tar.TypeReg, tar.TypeRegA:
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err = os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		linkName := path.Clean("/" + hdr.Linkname)
+		linkParent, linkBase := path.Split(linkName)
+		source, err := a.resolve(linkParent)
+		if err != nil {
+			return err
+		}
+		if err = os.Link(filepath.Join(source, linkBase), target); err != nil {
+			return err
+		}
+		// hardlink shares the inode as well as metadata with the source
+		a.markCreated(target)
+		return nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		mode := uint32(hdr.Mode & 07777)
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			mode |= syscall.S_IFCHR
+		case tar.TypeBlock:
+			mode |= syscall.S_IFBLK
+		case tar.TypeFifo:
+			mode |= syscall.S_IFIFO
+		}
+		if err = syscall.Mknod(target, mode, mkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
+			if err == syscall.EPERM && !a.chown {
+				a.logger.Warn(fmt.Sprintf("device %s skipped, permission denied", name))
+				return nil
+			}
+			return err
+		}
+	default:
+		a.logger.Debug(fmt.Sprintf("unsupported entry %s with type %c skipped", name, hdr.Typeflag))
+		return nil
+	}
+	a.markCreated(target)
+	if a.chown {
+		if err = os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+	// chmod after chown since chown clears setuid and setgid bits
+	if err = os.Chmod(target, hdr.FileInfo().Mode()); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		accessTime := hdr.AccessTime
+		if accessTime.IsZero() {
+			accessTime = hdr.ModTime
+		}
+		return os.Chtimes(target, accessTime, hdr.ModTime)
+	}
+	return nil
+}
+
+// whiteoutTarget returns the host path removed by whiteout of name inside of parent, names which don't refer to
+// an entry of parent are rejected so that whiteouts never remove parent itself or anything outside of rootfs.
+func (a *layerApplier) whiteoutTarget(parent, name string) (string, error) {
+	if len(name) == 0 || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", errors.New(fmt.Sprintf("whiteout target %s incorrect", name))
+	}
+	target := filepath.Clean(filepath.Join(parent, name))
+	rel, err := filepath.Rel(a.root, target)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New(fmt.Sprintf("whiteout target %s outside of rootfs", name))
+	}
+	return target, nil
+}
+
+// resolve returns the host path of directory name inside of rootfs, symlinks are followed as if rootfs is the
+// root directory, which means both absolute links and '..' never lead outside of rootfs.
+func (a *layerApplier) resolve(name string) (string, error) {
+	current := "/"
+	remaining := name
+	follows := 0
+	for len(remaining) != 0 {
+		component := remaining
+		remaining = ""
+		if index := strings.Index(component, "/"); index != -1 {
+			component, remaining = component[:index], component[index+1:]
+		}
+		if len(component) == 0 || component == "." {
+			continue
+		}
+		if component == ".." {
+			current = path.Dir(current)
+			continue
+		}
+		next := path.Join(current, component)
+		info, err := os.Lstat(filepath.Join(a.root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				current = next
+				continue
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		follows += 1
+		if follows > MAX_SYMLINK_FOLLOWS {
+			return "", errors.New(fmt.Sprintf("too many levels of symbolic links in %s", name))
+		}
+		link, err := os.Readlink(filepath.Join(a.root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			current = "/"
+		}
+		remaining = fmt.Sprintf("%s/%s", link, remaining)
+	}
+	return filepath.Join(a.root, current), nil
+}
+
+// removeChildren handles opaque whiteout, children from lower layers are removed
+func (a *layerApplier) removeChildren(dir string, dirTimes map[string]time.Time) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		child := filepath.Join(dir, entry.Name())
+		if a.created[child] {
+			continue
+		}
+		forgetDirTimes(dirTimes, child)
+		if err = os.RemoveAll(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetDirTimes drops mtimes of removed target and directories under it
+func forgetDirTimes(dirTimes map[string]time.Time, target string) {
+	prefix := target + string(filepath.Separator)
+	for dir := range dirTimes {
+		if dir == target || strings.HasPrefix(dir, prefix) {
+			delete(dirTimes, dir)
+		}
+	}
+}
+
+func (a *layerApplier) markCreated(target string) {
+	for target != a.root && target != "/" && target != "." {
+		a.created[target] = true
+		target = filepath.Dir(target)
+	}
+}
+
+// mkdev encodes device number in the same way as glibc makedev
+func mkdev(major, minor int64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
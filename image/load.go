@@ -2,29 +2,29 @@ package image
 
 import (
 	"context"
-	"errors"
-	"strings"
 )
 
-func LoadImage(im string, imageHandel *Handler) error {
-	var imageDetail = ImageDetail{
-		Name: im,
-	}
-
-	if strings.Contains(im, SWR) {
-		imageDetail.Type = SWR
-	} else if strings.Contains(im, DOCKER) {
-		imageDetail.Type = DOCKER
-	} else {
-		return errors.New("image type wrong")
+// LoadImage pulls image and loads it into lxd while holding the image lock, image is loaded again even if its
+// alias already exists.
+func (h *Handler) LoadImage(ctx context.Context, detail ImageDetail) (*Puller, error) {
+	puller, err := h.GetImagePuller(detail)
+	if err != nil {
+		return nil, err
 	}
-
-	pull, err := imageHandel.GetImagePuller(imageDetail)
+	unlock, err := h.lock(ctx, puller)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer unlock()
+	return puller, puller.Pull(ctx)
+}
 
-	pull.DownloadImage(context.Background(), imageHandel.closeCh)
+// Fingerprint returns fingerprint of image loaded into lxd
+func (p *Puller) Fingerprint() string {
+	return p.fingerprint
+}
 
-	return nil
+// Alias returns lxd alias of image, it's inferred from image name when not specified
+func (p *Puller) Alias() string {
+	return p.alias
 }
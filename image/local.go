@@ -0,0 +1,190 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+	"lxc-launcher/lxd"
+)
+
+const (
+	// metadata file at the top of unified image tarball
+	UNIFIED_METADATA = "metadata.yaml"
+	// prefix of folder where image bundles are extracted, inside of TMPDIR
+	BUNDLE_TEMP_PREFIX = "launcher-import-"
+)
+
+// tarball extensions trimmed when deriving alias from file name
+var tarballExtensions = []string{".tar.gz", ".tar.xz", ".tgz", ".tar"}
+
+// ImportLocalImage imports lxd image from local source without registry, for instance images copied onto nodes
+// without network access. Source is one of:
+//
+//	directory which contains lxd.tar.xz and rootfs.squashfs or disk.qcow2, or unified image tarball
+//	tarball bundle of the files above, it's extracted into TMPDIR before importing
+//	unified image tarball, which is imported as is
+//
+// Alias is derived from the file name when empty, and the fingerprint of imported image is returned.
+func ImportLocalImage(ctx context.Context, source, alias, instanceType string, lxdClient *lxd.Client, logger *zap.Logger) (string, error) {
+	switch instanceType {
+	case "", CONTAINER, VM:
+	default:
+		return "", errors.New(fmt.Sprintf("unsupported image type %s", instanceType))
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(filepath.Clean(source))
+	if len(alias) == 0 {
+		alias = name
+		for _, extension := range tarballExtensions {
+			if strings.HasSuffix(alias, extension) {
+				alias = strings.TrimSuffix(alias, extension)
+				break
+			}
+		}
+	}
+	puller := &Puller{
+		imageName:    name,
+		alias:        alias,
+		instanceType: instanceType,
+		lxdClient:    lxdClient,
+		logger:       logger,
+		retain:       1,
+	}
+	if info.IsDir() {
+		puller.FileNameList = GetFileList(source)
+		err = puller.loadLXDImages(ctx)
+	} else {
+		err = puller.importTarball(ctx, source)
+	}
+	if err != nil {
+		return "", err
+	}
+	return puller.fingerprint, nil
+}
+
+// importTarball imports bundle of lxd image files or unified image tarball
+func (p *Puller) importTarball(ctx context.Context, tarball string) error {
+	bundle, err := isImageBundle(tarball)
+	if err != nil {
+		return err
+	}
+	if !bundle {
+		// unified tarballs contain rootfs folder, which are container images
+		imageType := p.instanceType
+		if len(imageType) == 0 {
+			imageType = CONTAINER
+		}
+		p.logger.Info(fmt.Sprintf("importing %s as unified image tarball", tarball))
+		return p.createImage(ctx, imageType, p.alias, tarball, "")
+	}
+	folder, err := ioutil.TempDir("", BUNDLE_TEMP_PREFIX)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(folder)
+	p.logger.Info(fmt.Sprintf("extracting image bundle %s into %s", tarball, folder))
+	if p.FileNameList, err = extractImageBundle(tarball, folder); err != nil {
+		return errors.New(fmt.Sprintf("failed to extract image bundle %s, %s", tarball, err))
+	}
+	return p.loadLXDImages(ctx)
+}
+
+// isLXDImageFile checks whether file is metadata or rootfs of lxd image
+func isLXDImageFile(name string) bool {
+	return strings.Contains(name, LXD_TYPE) || strings.Contains(name, CONTAINER_TYPE) ||
+		strings.Contains(name, VM_TYPE) || name == METADATA_IMAGE || name == UNIFIED_IMAGE
+}
+
+// openTarball opens tarball which is either gzip compressed or plain, the returned function closes it
+func openTarball(tarball string) (*tar.Reader, func(), error) {
+	file, err := os.Open(tarball)
+	if err != nil {
+		return nil, nil, err
+	}
+	bufReader := bufio.NewReader(file)
+	if magic, err := bufReader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gReader, err := gzip.NewReader(bufReader)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(gReader), func() {
+			gReader.Close()
+			file.Close()
+		}, nil
+	}
+	return tar.NewReader(bufReader), func() {
+		file.Close()
+	}, nil
+}
+
+// isImageBundle checks whether tarball is bundle of lxd image files, tarballs which can't be read (xz compressed
+// for instance) are regarded as unified image tarballs and left to lxd.
+func isImageBundle(tarball string) (bool, error) {
+	tr, closeFunc, err := openTarball(tarball)
+	if err != nil {
+		return false, err
+	}
+	defer closeFunc()
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			return false, nil
+		}
+		name := path.Clean("/" + hdr.Name)
+		if name == "/"+UNIFIED_METADATA {
+			return false, nil
+		}
+		if hdr.FileInfo().Mode().IsRegular() && isLXDImageFile(path.Base(name)) {
+			return true, nil
+		}
+	}
+}
+
+// extractImageBundle extracts lxd image files in tarball into folder, other entries are ignored
+func extractImageBundle(tarball, folder string) ([]string, error) {
+	tr, closeFunc, err := openTarball(tarball)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFunc()
+	var files []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		baseName := path.Base(path.Clean("/" + hdr.Name))
+		if !hdr.FileInfo().Mode().IsRegular() || !isLXDImageFile(baseName) {
+			continue
+		}
+		target := filepath.Join(folder, baseName)
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(file, tr)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, target)
+	}
+}
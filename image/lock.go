@@ -0,0 +1,106 @@
+package image
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/fileutil"
+	"lxc-launcher/util"
+)
+
+const (
+	// folder of image lock files inside of data folder
+	LOCK_DIR = "locks"
+	// interval between two attempts of taking image lock held by others
+	FILE_LOCK_INTERVAL = time.Second
+)
+
+// keyLocks provides mutual exclusion per key, for instance blob digest or image reference, the lock of key is
+// dropped once nobody holds or waits for it.
+type keyLocks struct {
+	mutex sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{
+		locks: map[string]*keyLock{},
+	}
+}
+
+// Lock blocks until lock of key acquired, the returned function releases it
+func (k *keyLocks) Lock(key string) func() {
+	k.mutex.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.refs += 1
+	k.mutex.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		k.mutex.Lock()
+		l.refs -= 1
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mutex.Unlock()
+	}
+}
+
+// LockImage takes node wide lock of image inside of data folder, so that manage command and launchers on the same
+// node never pull the same image concurrently. It blocks until lock acquired or ctx done, the returned function
+// releases it.
+func LockImage(ctx context.Context, dataFolder, reference string) (func(), error) {
+	folder := filepath.Join(dataFolder, LOCK_DIR)
+	if err := os.MkdirAll(folder, 0755); err != nil {
+		return nil, err
+	}
+	lockFile := filepath.Join(folder, util.GetImagePath(reference)+".lock")
+	for {
+		file, err := fileutil.TryLockFile(lockFile, os.O_WRONLY|os.O_CREATE, fileutil.PrivateFileMode)
+		if err == nil {
+			return func() {
+				file.Close()
+			}, nil
+		}
+		if err != fileutil.ErrLocked {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(FILE_LOCK_INTERVAL):
+		}
+	}
+}
+
+// flockFile takes flock of file in mode of syscall.LOCK_SH or syscall.LOCK_EX, it blocks until lock acquired or
+// ctx done. Lock held by the file is converted to the mode.
+func flockFile(ctx context.Context, file *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(FILE_LOCK_INTERVAL):
+		}
+	}
+}
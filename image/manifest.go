@@ -0,0 +1,159 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+const (
+	MEDIA_TYPE_DOCKER_SCHEMA1        = "application/vnd.docker.distribution.manifest.v1+json"
+	MEDIA_TYPE_DOCKER_SCHEMA1_SIGNED = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	MEDIA_TYPE_DOCKER_SCHEMA2        = "application/vnd.docker.distribution.manifest.v2+json"
+	MEDIA_TYPE_DOCKER_MANIFEST_LIST  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MEDIA_TYPE_OCI_MANIFEST          = "application/vnd.oci.image.manifest.v1+json"
+	MEDIA_TYPE_OCI_INDEX             = "application/vnd.oci.image.index.v1+json"
+)
+
+// MANIFEST_ACCEPT_TYPES are the manifest media types negotiated with registry, in the order of preference
+var MANIFEST_ACCEPT_TYPES = []string{
+	MEDIA_TYPE_OCI_INDEX,
+	MEDIA_TYPE_DOCKER_MANIFEST_LIST,
+	MEDIA_TYPE_OCI_MANIFEST,
+	MEDIA_TYPE_DOCKER_SCHEMA2,
+	MEDIA_TYPE_DOCKER_SCHEMA1_SIGNED,
+	MEDIA_TYPE_DOCKER_SCHEMA1,
+}
+
+// kernelArchitectures maps kernel architecture reported by lxd server to OCI platform architecture and variant
+var kernelArchitectures = map[string][2]string{
+	"x86_64":  {"amd64", ""},
+	"i686":    {"386", ""},
+	"aarch64": {"arm64", ""},
+	"armv7l":  {"arm", "v7"},
+	"armv6l":  {"arm", "v6"},
+	"ppc64le": {"ppc64le", ""},
+	"s390x":   {"s390x", ""},
+	"riscv64": {"riscv64", ""},
+	"mips64":  {"mips64", ""},
+}
+
+// ManifestResponse covers docker schema1, docker schema2, OCI image manifest as well as manifest list and index
+type ManifestResponse struct {
+	SchemaVersion int                    `json:"schemaVersion"`
+	MediaType     string                 `json:"mediaType"`
+	Config        *ManifestDescriptor    `json:"config,omitempty"`
+	Layers        []ManifestDescriptor   `json:"layers"`
+	Manifests     []ManifestDescriptor   `json:"manifests"`
+	FSLayers      []DockerManifestLayers `json:"fsLayers"`
+	// content type and verified digest of manifest response
+	ContentType string `json:"-"`
+	Digest      string `json:"-"`
+}
+
+type ManifestDescriptor struct {
+	MediaType string            `json:"mediaType"`
+	Digest    string            `json:"digest"`
+	Size      int64             `json:"size"`
+	Platform  *ManifestPlatform `json:"platform,omitempty"`
+	// annotations of layer, signature manifests carry signatures in it
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ManifestPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+type DockerManifestLayers struct {
+	BlobSum string `json:"blobSum"`
+}
+
+// IsIndex returns whether the manifest is a manifest list or OCI index which refers to platform manifests
+func (m *ManifestResponse) IsIndex() bool {
+	mediaType := m.MediaType
+	if len(mediaType) == 0 {
+		mediaType = m.ContentType
+	}
+	return mediaType == MEDIA_TYPE_DOCKER_MANIFEST_LIST || mediaType == MEDIA_TYPE_OCI_INDEX ||
+		(len(m.Manifests) != 0 && len(m.Layers) == 0)
+}
+
+// IsSchema1 returns whether the manifest is docker schema1 manifest whose digest is computed without signatures
+func (m *ManifestResponse) IsSchema1() bool {
+	return m.SchemaVersion == 1 || m.ContentType == MEDIA_TYPE_DOCKER_SCHEMA1 ||
+		m.ContentType == MEDIA_TYPE_DOCKER_SCHEMA1_SIGNED
+}
+
+// LayerDigests returns the layer digests from the lowest to the topmost layer
+func (m *ManifestResponse) LayerDigests() []string {
+	var digests []string
+	if len(m.Layers) != 0 {
+		for _, l := range m.Layers {
+			digests = append(digests, l.Digest)
+		}
+		return digests
+	}
+	// schema1 lists layers from the topmost, empty layers are repeated and skipped
+	seen := map[string]bool{}
+	for i := len(m.FSLayers) - 1; i >= 0; i-- {
+		if seen[m.FSLayers[i].BlobSum] {
+			continue
+		}
+		seen[m.FSLayers[i].BlobSum] = true
+		digests = append(digests, m.FSLayers[i].BlobSum)
+	}
+	return digests
+}
+
+// SelectPlatform returns the manifest digest in index matching the architecture and variant on linux
+func (m *ManifestResponse) SelectPlatform(architecture, variant string) (string, error) {
+	var candidate string
+	for _, d := range m.Manifests {
+		if d.Platform == nil {
+			continue
+		}
+		if d.Platform.OS != "linux" || d.Platform.Architecture != architecture {
+			continue
+		}
+		if d.Platform.Variant == variant {
+			return d.Digest, nil
+		}
+		if len(candidate) == 0 {
+			candidate = d.Digest
+		}
+	}
+	if len(candidate) != 0 {
+		return candidate, nil
+	}
+	return "", errors.New(fmt.Sprintf("no manifest found for platform linux/%s%s",
+		architecture, strings.TrimRight("/"+variant, "/")))
+}
+
+// PlatformFromKernelArchitecture converts kernel architecture (x86_64, aarch64) into OCI architecture and variant,
+// architecture of the launcher is used when kernel architecture is empty.
+func PlatformFromKernelArchitecture(kernelArchitecture string) (string, string) {
+	if platform, ok := kernelArchitectures[kernelArchitecture]; ok {
+		return platform[0], platform[1]
+	}
+	if len(kernelArchitecture) != 0 {
+		return kernelArchitecture, ""
+	}
+	return runtime.GOARCH, ""
+}
+
+// KernelArchitectureFromPlatform converts OCI architecture and variant into kernel architecture used by lxd,
+// arm without variant is considered as armv7l.
+func KernelArchitectureFromPlatform(architecture, variant string) string {
+	if architecture == "arm" && len(variant) == 0 {
+		variant = "v7"
+	}
+	for kernelArchitecture, platform := range kernelArchitectures {
+		if platform[0] == architecture && platform[1] == variant {
+			return kernelArchitecture
+		}
+	}
+	return architecture
+}
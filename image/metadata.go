@@ -0,0 +1,166 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	METADATA_VERSION_V1 = "v1"
+	// registry types declared in legacy schema, they are regarded as empty type
+	LEGACY_TYPE_DOCKER = "docker"
+	LEGACY_TYPE_SWR    = "swr"
+)
+
+// ImageMetadata is the response of metadata endpoint. Images of legacy schema (without version) are either
+// image names or objects with name and type, images of v1 schema are objects of imageEntry.
+type ImageMetadata struct {
+	Version string            `json:"version"`
+	Images  []json.RawMessage `json:"images"`
+}
+
+// imageEntry is the image declared in v1 metadata schema
+type imageEntry struct {
+	Reference string `json:"reference"`
+	// name is accepted as the reference for compatibility with legacy schema
+	Name         string `json:"name"`
+	Alias        string `json:"alias"`
+	Type         string `json:"type"`
+	Architecture string `json:"architecture"`
+	Digest       string `json:"digest"`
+	Priority     int    `json:"priority"`
+	KeepPrevious bool   `json:"keepPrevious"`
+}
+
+// ParseImageMetadata decodes response of metadata endpoint, the returned images are validated and sorted by
+// priority from the highest. Invalid images are skipped so that they don't block syncing of the others.
+func ParseImageMetadata(content []byte, logger *zap.Logger) ([]ImageDetail, error) {
+	var metadata ImageMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to get image meta info from api response: %s", err))
+	}
+	switch metadata.Version {
+	case "", METADATA_VERSION_V1:
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported image metadata version %s", metadata.Version))
+	}
+	details := make([]ImageDetail, 0, len(metadata.Images))
+	for _, raw := range metadata.Images {
+		var name string
+		if err := json.Unmarshal(raw, &name); err == nil {
+			details = append(details, ImageDetail{Name: name})
+			continue
+		}
+		var entry imageEntry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			logger.Warn(fmt.Sprintf("skip image entry %s, %s", string(raw), err))
+			continue
+		}
+		switch entry.Type {
+		case LEGACY_TYPE_DOCKER, LEGACY_TYPE_SWR:
+			entry.Type = ""
+		}
+		detail := ImageDetail{
+			Name:         entry.Reference,
+			Alias:        entry.Alias,
+			Type:         entry.Type,
+			Architecture: entry.Architecture,
+			Digest:       entry.Digest,
+			Priority:     entry.Priority,
+			KeepPrevious: entry.KeepPrevious,
+		}
+		if len(detail.Name) == 0 {
+			detail.Name = entry.Name
+		}
+		details = append(details, detail)
+	}
+	valid := make([]ImageDetail, 0, len(details))
+	for _, detail := range details {
+		if err := detail.Validate(); err != nil {
+			logger.Warn(fmt.Sprintf("skip image %s, %s", detail.Name, err))
+			continue
+		}
+		valid = append(valid, detail)
+	}
+	SortImageDetails(valid)
+	return valid, nil
+}
+
+// Validate checks image detail declared in metadata
+func (d *ImageDetail) Validate() error {
+	if _, err := d.FullName(); err != nil {
+		return err
+	}
+	switch d.Type {
+	case "", CONTAINER, VM:
+	default:
+		return errors.New(fmt.Sprintf("image %s has unsupported type %s", d.Name, d.Type))
+	}
+	if strings.ContainsAny(d.Alias, "/"+VERSION_ALIAS_SEPARATOR) {
+		return errors.New(fmt.Sprintf("image %s has incorrect alias %s", d.Name, d.Alias))
+	}
+	return nil
+}
+
+// FullName returns image reference pulled from registry, the pinned digest is appended when specified
+func (d *ImageDetail) FullName() (string, error) {
+	reference, err := ParseReference(d.Name)
+	if err != nil {
+		return "", err
+	}
+	if len(d.Digest) == 0 {
+		return d.Name, nil
+	}
+	if !strings.Contains(d.Digest, ":") {
+		return "", errors.New(fmt.Sprintf("image %s has incorrect digest %s", d.Name, d.Digest))
+	}
+	if len(reference.Digest) != 0 {
+		if reference.Digest != d.Digest {
+			return "", errors.New(fmt.Sprintf("image %s is pinned to different digest %s", d.Name, d.Digest))
+		}
+		return d.Name, nil
+	}
+	return fmt.Sprintf("%s@%s", d.Name, d.Digest), nil
+}
+
+// reference returns the normalized full name of image, the declared name is returned if it's incorrect
+func (d *ImageDetail) reference() string {
+	name, err := d.FullName()
+	if err != nil {
+		return d.Name
+	}
+	if reference, err := ParseReference(name); err == nil {
+		return reference.String()
+	}
+	return name
+}
+
+// key identifies image when deduplicating syncs and recording states, the same reference declared with different
+// aliases or types are different images in lxd
+func (d *ImageDetail) key() string {
+	return fmt.Sprintf("%s|%s|%s", d.reference(), d.Type, d.Alias)
+}
+
+// SortImageDetails sorts images by priority from the highest, the declared order is kept for the same priority
+func SortImageDetails(details []ImageDetail) {
+	sort.SliceStable(details, func(i, j int) bool {
+		return details[i].Priority > details[j].Priority
+	})
+}
+
+// platformFromArchitecture converts architecture declared in metadata into OCI platform, both kernel
+// architectures (x86_64, aarch64) and OCI platforms (amd64, arm/v7) are accepted.
+func platformFromArchitecture(architecture string) (string, string) {
+	if components := strings.SplitN(architecture, "/", 2); len(components) == 2 {
+		return components[0], components[1]
+	}
+	if _, ok := kernelArchitectures[architecture]; ok {
+		return PlatformFromKernelArchitecture(architecture)
+	}
+	return architecture, ""
+}
@@ -0,0 +1,270 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	PULL_STATUS_RESOLVING   = "resolving"
+	PULL_STATUS_DOWNLOADING = "downloading"
+	PULL_STATUS_EXTRACTING  = "extracting"
+	PULL_STATUS_CONVERTING  = "converting"
+	PULL_STATUS_LOADING     = "loading"
+	PULL_STATUS_FINISHED    = "finished"
+	PULL_STATUS_FAILED      = "failed"
+	// interval between two progress logs while downloading blobs
+	PROGRESS_LOG_INTERVAL = 10 * time.Second
+	// max bytes read at once from registry when bandwidth limited, it's the burst of the limiter as well
+	MAX_RATE_BURST = 1024 * 1024
+)
+
+// BlobProgress is the download progress of one blob
+type BlobProgress struct {
+	Digest     string `json:"digest"`
+	Size       int64  `json:"size"`
+	Downloaded int64  `json:"downloaded"`
+	// blob found in blob store and not downloaded again
+	Cached bool `json:"cached"`
+}
+
+// ImageProgress is the pull progress of one image, sizes are unknown(0) for schema1 manifests
+type ImageProgress struct {
+	Image      string          `json:"image"`
+	Status     string          `json:"status"`
+	Size       int64           `json:"size"`
+	Downloaded int64           `json:"downloaded"`
+	Blobs      []*BlobProgress `json:"blobs"`
+	StartedAt  time.Time       `json:"startedAt"`
+	UpdatedAt  time.Time       `json:"updatedAt"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Summary returns the progress in human readable format for logging
+func (i *ImageProgress) Summary() string {
+	cached := 0
+	for _, blob := range i.Blobs {
+		if blob.Cached {
+			cached += 1
+		}
+	}
+	if i.Size == 0 {
+		return fmt.Sprintf("%s, %d bytes downloaded, %d/%d blobs cached", i.Status, i.Downloaded, cached,
+			len(i.Blobs))
+	}
+	return fmt.Sprintf("%s, %d/%d bytes(%.1f%%) downloaded, %d/%d blobs cached", i.Status, i.Downloaded, i.Size,
+		float64(i.Downloaded)*100/float64(i.Size), cached, len(i.Blobs))
+}
+
+// ProgressTracker tracks the pull progress of images, it's shared by pullers of image handler
+type ProgressTracker struct {
+	mutex  sync.Mutex
+	images map[string]*ImageProgress
+}
+
+func NewProgressTracker() *ProgressTracker {
+	return &ProgressTracker{
+		images: map[string]*ImageProgress{},
+	}
+}
+
+// Start resets progress of image when pulling started
+func (t *ProgressTracker) Start(image string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	t.images[image] = &ImageProgress{
+		Image:     image,
+		Status:    PULL_STATUS_RESOLVING,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+}
+
+func (t *ProgressTracker) SetStatus(image, status string) {
+	t.update(image, func(progress *ImageProgress) {
+		progress.Status = status
+	})
+}
+
+// SetBlobs records blobs of image with the sizes declared in manifest
+func (t *ProgressTracker) SetBlobs(image string, blobs []ManifestDescriptor) {
+	t.update(image, func(progress *ImageProgress) {
+		progress.Blobs = nil
+		progress.Size = 0
+		progress.Downloaded = 0
+		for _, blob := range blobs {
+			progress.Blobs = append(progress.Blobs, &BlobProgress{Digest: blob.Digest, Size: blob.Size})
+			progress.Size += blob.Size
+		}
+	})
+}
+
+// SetCached marks blob as found in blob store
+func (t *ProgressTracker) SetCached(image, digest string) {
+	t.updateBlob(image, digest, func(blob *BlobProgress) {
+		blob.Cached = true
+		blob.Downloaded = blob.Size
+	})
+}
+
+// SetDownloaded sets downloaded bytes of blob, it's used when download is resumed or restarted
+func (t *ProgressTracker) SetDownloaded(image, digest string, downloaded int64) {
+	t.updateBlob(image, digest, func(blob *BlobProgress) {
+		blob.Downloaded = downloaded
+	})
+}
+
+// Add adds bytes downloaded for blob
+func (t *ProgressTracker) Add(image, digest string, n int64) {
+	t.updateBlob(image, digest, func(blob *BlobProgress) {
+		blob.Downloaded += n
+	})
+}
+
+// Finish marks image as finished or failed when err not nil
+func (t *ProgressTracker) Finish(image string, err error) {
+	t.update(image, func(progress *ImageProgress) {
+		if err != nil {
+			progress.Status = PULL_STATUS_FAILED
+			progress.Error = err.Error()
+			return
+		}
+		progress.Status = PULL_STATUS_FINISHED
+		progress.Error = ""
+	})
+}
+
+// Get returns copy of image progress
+func (t *ProgressTracker) Get(image string) (ImageProgress, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	progress, ok := t.images[image]
+	if !ok {
+		return ImageProgress{}, false
+	}
+	return progress.copy(), true
+}
+
+// List returns copies of all image progresses sorted by image
+func (t *ProgressTracker) List() []ImageProgress {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var progresses []ImageProgress
+	for _, progress := range t.images {
+		progresses = append(progresses, progress.copy())
+	}
+	sort.Slice(progresses, func(i, j int) bool {
+		return progresses[i].Image < progresses[j].Image
+	})
+	return progresses
+}
+
+// Handler serves progresses in json, single image is returned when image specified in query
+func (t *ProgressTracker) Handler(w http.ResponseWriter, req *http.Request) {
+	var result interface{}
+	if image := req.URL.Query().Get("image"); len(image) != 0 {
+		progress, ok := t.Get(image)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(fmt.Sprintf("image %s not found", image)))
+			return
+		}
+		result = progress
+	} else {
+		result = t.List()
+	}
+	content, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("failed to encode progress, %s", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
+
+func (t *ProgressTracker) update(image string, updateFunc func(progress *ImageProgress)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	progress, ok := t.images[image]
+	if !ok {
+		return
+	}
+	updateFunc(progress)
+	progress.UpdatedAt = time.Now()
+}
+
+func (t *ProgressTracker) updateBlob(image, digest string, updateFunc func(blob *BlobProgress)) {
+	t.update(image, func(progress *ImageProgress) {
+		for _, blob := range progress.Blobs {
+			if blob.Digest == digest {
+				updateFunc(blob)
+			}
+		}
+		progress.Downloaded = 0
+		for _, blob := range progress.Blobs {
+			progress.Downloaded += blob.Downloaded
+		}
+	})
+}
+
+func (i *ImageProgress) copy() ImageProgress {
+	progress := *i
+	progress.Blobs = nil
+	for _, blob := range i.Blobs {
+		b := *blob
+		progress.Blobs = append(progress.Blobs, &b)
+	}
+	return progress
+}
+
+// NewRateLimiter creates limiter shared by all downloads, nil is returned when bytesPerSecond is not positive
+// which means unlimited.
+func NewRateLimiter(bytesPerSecond int64) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := bytesPerSecond
+	if burst > MAX_RATE_BURST {
+		burst = MAX_RATE_BURST
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), int(burst))
+}
+
+// progressReader counts bytes read from registry and throttles reading when limiter specified
+type progressReader struct {
+	ctx     context.Context
+	reader  io.ReadCloser
+	limiter *rate.Limiter
+	onRead  func(n int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	if r.limiter != nil && len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.onRead(int64(n))
+		if r.limiter != nil {
+			if waitErr := r.limiter.WaitN(r.ctx, n); waitErr != nil && err == nil {
+				err = waitErr
+			}
+		}
+	}
+	return n, err
+}
+
+func (r *progressReader) Close() error {
+	return r.reader.Close()
+}
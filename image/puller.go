@@ -1,8 +1,6 @@
 package image
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
@@ -10,12 +8,11 @@ import (
 	"go.etcd.io/etcd/client/pkg/v3/fileutil"
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
-	"io"
+	"golang.org/x/time/rate"
 	"io/ioutil"
 	"lxc-launcher/lxd"
 	"lxc-launcher/util"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
@@ -24,221 +21,254 @@ import (
 	"time"
 )
 
-
 var (
-	DEFAULT_TIMEOUT       = 10
-	DOCKER_CONTENT_DIGEST = "Docker-Content-Digest"
-	MANIFEST_DIGEST       = "manifest.digest"
-	httpClient            *http.Client
-	ROOTFS_DIR            = "rootfs"
-)
-
-type RegistryType int32
-
-const (
-	SWRRegistry RegistryType = iota
-	DockerRegistry
+	DEFAULT_TIMEOUT = 10
+	// token lifetime defined in docker registry token spec when expires_in absent
+	DEFAULT_TOKEN_EXPIRATION = 60
+	DOCKER_CONTENT_DIGEST    = "Docker-Content-Digest"
+	MANIFEST_DIGEST          = "manifest.digest"
+	ROOTFS_DIR               = "rootfs"
 )
 
-type tokenResponse struct {
-	Token     string    `json:"token"`
-	ExpiresIn int       `json:"expires_in"`
-	IssuedAt  time.Time `json:"issued_at"`
+// RegistryOptions are the options used when communicating with registries
+type RegistryOptions struct {
+	Username string
+	Password string
+	// registries accessed via plain http, in the format of host[:port]
+	InsecureRegistries []string
+	// mirrors of upstream registry host in the order of preference, upstream is used when all of them failed
+	Mirrors map[string][]string
+	// proxy url for registry requests, proxy environments are used when empty
+	Proxy string
+	// PEM bundle of CA certificates trusted in addition to system pool
+	CABundle string
+	// docker config.json or dockerconfigjson with per registry credentials, it takes precedence over
+	// username and password
+	AuthFile     string
+	dockerConfig *DockerConfig
+	// download bandwidth in bytes per second shared by all blobs, unlimited when not positive
+	RateLimit int64
+	limiter   *rate.Limiter
 }
 
-type SWRManifestResponse struct {
-	Layers []SWRManifestLayers `json:"layers"`
-}
-
-type SWRManifestLayers struct {
-	MediaType string `json:"mediaType"`
-	Type      string `json:"type"`
-	Digest    string `json:"digest"`
+func (o *RegistryOptions) isInsecure(host string) bool {
+	for _, r := range o.InsecureRegistries {
+		if r == host {
+			return true
+		}
+	}
+	return false
 }
 
-type DockerManifestResponse struct {
-	Layers []DockerManifestLayers `json:"fsLayers"`
+// credentials returns credentials of registry host, username and password are used for upstream registry
+// when not found in auth file
+func (o *RegistryOptions) credentials(host string, upstream bool) (string, string, error) {
+	if o.dockerConfig != nil {
+		username, password, found, err := o.dockerConfig.Credentials(host)
+		if err != nil || found {
+			return username, password, err
+		}
+	}
+	if upstream {
+		return o.Username, o.Password, nil
+	}
+	return "", "", nil
 }
 
-type DockerManifestLayers struct {
-	BlobSum string `json:"blobSum"`
+// endpointURL completes registry or mirror address with scheme
+func (o *RegistryOptions) endpointURL(address string) string {
+	if strings.Contains(address, "://") {
+		return address
+	}
+	if o.isInsecure(address) {
+		return fmt.Sprintf("http://%s", address)
+	}
+	return fmt.Sprintf("https://%s", address)
 }
 
 type Puller struct {
-	username         string
-	password         string
-	authEndpoint     string
-	registryEndpoint string
-	serviceName      string
-	registryToken    string
-	tokenExpiration  time.Time
-	imageName        string
-	imageTag         string
-	logger           *zap.Logger
-	imageFolder      string
-	registryType     RegistryType
-	canceled         *atomic.Bool
-	imageDigest      string
-	lxdClient        *lxd.Client
-	FileNameList     []string
+	// mirrors followed by upstream registry
+	endpoints []*registryEndpoint
+	client    *http.Client
+	// client without registry authorization
+	baseClient     *http.Client
+	reference      *Reference
+	imageName      string
+	imageTag       string
+	logger         *zap.Logger
+	imageFolder    string
+	canceled       *atomic.Bool
+	imageDigest    string
+	manifestDigest string
+	// digest computed from the manifest fetched by tag, which could be an index, it's empty for schema1 manifest
+	indexDigest    string
+	lxdClient      *lxd.Client
+	FileNameList   []string
+	architecture   string
+	variant        string
+	blobStore      *BlobStore
+	configDigest   string
+	convertOptions ConvertOptions
+	converted      bool
+	// signature verification is skipped when nil
+	signatureVerifier *SignatureVerifier
+	progress          *ProgressTracker
+	limiter           *rate.Limiter
+	// lxd alias and instance type of image, they are inferred from image name when empty
+	alias        string
+	instanceType string
+	// fingerprint of image loaded into lxd
+	fingerprint string
+	// versions of alias retained for rollback
+	retain int
 }
 
-func newImagePuller(username, password, baseFolder, imageFullName string, logger *zap.Logger, registry string) (*Puller, error) {
+// NewImagePuller creates puller for image on any registry which implements docker registry v2 api, the registry
+// host is parsed from image name and docker hub is used if not specified. Blobs are cached in blobStore, a store
+// inside of base folder is used when it's nil.
+func NewImagePuller(options RegistryOptions, blobStore *BlobStore, baseFolder, imageFullName string,
+	logger *zap.Logger, lxdClient *lxd.Client) (*Puller, error) {
 	if !fileutil.Exist(baseFolder) {
 		return nil, errors.New(fmt.Sprintf("base folder %s not existed", baseFolder))
 	}
-	registryUrl, err := url.Parse(registry)
+	reference, err := ParseReference(imageFullName)
 	if err != nil {
 		return nil, err
 	}
-	puller := &Puller{
-		username:         username,
-		password:         password,
-		logger:           logger,
-		canceled:         atomic.NewBool(false),
-		registryEndpoint: registry,
-	}
-
-	imageIDs := strings.Split(imageFullName, ":")
-	if len(imageIDs) > 2 {
-		return nil, errors.New(fmt.Sprintf("image ID %s incorreect", imageFullName))
-	} else if len(imageIDs) == 1 {
-		puller.imageName = imageFullName
-		puller.imageTag = "latest"
-		puller.imageFolder = path.Join(baseFolder, util.GetImagePath(fmt.Sprintf("%s:latest", imageFullName)))
-	} else {
-		puller.imageName = imageIDs[0]
-		puller.imageTag = imageIDs[1]
-		puller.imageFolder = path.Join(baseFolder, util.GetImagePath(imageFullName))
-	}
-	httpClient = &http.Client{
-		Transport: &http.Transport{
-			Proxy: func(req *http.Request) (*url.URL, error) {
-				if !puller.tokenValid() {
-					if err := puller.refreshToken(); err != nil {
-						return nil, err
-					}
-				}
-				// only add authorization when request registry host.
-				if strings.Contains(req.URL.String(), registryUrl.Host) {
-					req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", puller.registryToken))
-				}
-				return nil, nil
-			},
-		},
-	}
-	return puller, nil
-}
-
-func (p *Puller) Cancel() {
-	p.canceled.Store(true)
-}
-
-func (p *Puller) tokenValid() bool {
-	if len(p.registryToken) == 0 {
-		return false
-	}
-	now := time.Now()
-	if now.After(p.tokenExpiration) {
-		return false
-	}
-	return true
-}
-
-func (p *Puller) refreshToken() error {
-	realm := fmt.Sprintf("%s?service=%s&scope=repository:%s:pull", strings.TrimRight(p.authEndpoint,
-		"/"), p.serviceName, p.imageName)
-	p.logger.Info(fmt.Sprintf("start to refresh registry token for image %s:%s", p.imageName, p.imageTag))
-	reqUrl, err := url.Parse(realm)
-	if err != nil {
-		return err
+	if blobStore == nil {
+		if blobStore, err = NewBlobStore(baseFolder, logger); err != nil {
+			return nil, err
+		}
 	}
-	req, err := http.NewRequest("GET", reqUrl.String(), nil)
+	transport, err := newRegistryTransport(options)
 	if err != nil {
-		return err
-	}
-	if len(p.username) != 0 && len(p.password) != 0 {
-		req.SetBasicAuth(p.username, p.password)
+		return nil, err
 	}
-	cl := &http.Client{
-		Timeout: time.Duration(DEFAULT_TIMEOUT) * time.Second,
+	puller := &Puller{
+		logger:      logger,
+		canceled:    atomic.NewBool(false),
+		reference:   reference,
+		imageName:   reference.Repository,
+		imageTag:    reference.Reference(),
+		imageFolder: path.Join(baseFolder, util.GetImagePath(reference.String())),
+		lxdClient:   lxdClient,
+		blobStore:   blobStore,
+		baseClient:  &http.Client{Transport: transport},
+		progress:    NewProgressTracker(),
+		retain:      1,
+		limiter:     options.limiter,
+	}
+	if puller.limiter == nil {
+		puller.limiter = NewRateLimiter(options.RateLimit)
+	}
+	mirrors := options.Mirrors[reference.Registry]
+	if len(mirrors) == 0 {
+		mirrors = options.Mirrors[reference.Host()]
+	}
+	for _, mirror := range mirrors {
+		endpoint, err := newRegistryEndpoint(options.endpointURL(mirror), reference.Repository, "", "",
+			true, logger)
+		if err != nil {
+			return nil, err
+		}
+		if endpoint.username, endpoint.password, err = options.credentials(endpoint.host, false); err != nil {
+			return nil, err
+		}
+		puller.endpoints = append(puller.endpoints, endpoint)
 	}
-	resp, err := cl.Do(req)
+	username, password, err := options.credentials(reference.Registry, true)
 	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return errors.New(fmt.Sprintf("failed to refresh registry token: %s", string(bodyBytes)))
-	}
-	decoder := json.NewDecoder(resp.Body)
-	var tr tokenResponse
-	if err = decoder.Decode(&tr); err != nil {
-		return errors.New(fmt.Sprintf("failed to decode registry token: %s", err))
-	}
-	p.registryToken = tr.Token
-	if tr.IssuedAt.IsZero() {
-		tr.IssuedAt = time.Now().UTC()
+		return nil, err
 	}
-	p.tokenExpiration = tr.IssuedAt.Add(time.Duration(tr.ExpiresIn) * time.Second)
-	return nil
-}
-
-func NewSWRV2ImagePuller(username, password, baseFolder, region, imageFullName string, logger *zap.Logger, lxdClient *lxd.Client) (*Puller, error) {
-	puller, err := newImagePuller(username, password, baseFolder, imageFullName, logger,
-		fmt.Sprintf("https://%s/v2", region))
+	upstream, err := newRegistryEndpoint(options.endpointURL(reference.Host()), reference.Repository,
+		username, password, false, logger)
 	if err != nil {
 		return nil, err
 	}
-	puller.authEndpoint = fmt.Sprintf("https://%s/swr/auth/v2/registry/auth", region)
-	puller.serviceName = "dockyard"
-	puller.registryType = SWRRegistry
-	puller.lxdClient = lxdClient
-	if err := puller.refreshToken(); err != nil {
-		return nil, err
+	puller.endpoints = append(puller.endpoints, upstream)
+	auth := &authTransport{
+		base:      transport,
+		client:    puller.baseClient,
+		endpoints: map[string]*registryEndpoint{},
+	}
+	for _, endpoint := range puller.endpoints {
+		auth.endpoints[endpoint.host] = endpoint
 	}
+	puller.client = &http.Client{Transport: auth}
 	return puller, nil
 }
 
-func NewDockerIOV2ImagePuller(username, password, baseFolder, imageFullName string, logger *zap.Logger, lxdClient *lxd.Client) (*Puller, error) {
-	puller, err := newImagePuller(username, password, baseFolder, imageFullName, logger,
-		"https://registry-1.docker.io/v2")
-	if err != nil {
-		return nil, err
-	}
-	puller.authEndpoint = "https://auth.docker.io/token"
-	puller.serviceName = "registry.docker.io"
-	puller.registryType = DockerRegistry
-	puller.lxdClient = lxdClient
-	if err := puller.refreshToken(); err != nil {
-		return nil, err
+func (p *Puller) Cancel() {
+	p.canceled.Store(true)
+}
+
+// request sends request to mirrors in order and falls back to the next one when unreachable, server error or
+// content missing in mirror, the upstream response is returned as is.
+func (p *Puller) request(ctx context.Context, method, path string, header http.Header) (*http.Response, error) {
+	var lastErr error
+	for i, endpoint := range p.endpoints {
+		last := i == len(p.endpoints)-1
+		if endpoint.failed.Load() && !last {
+			continue
+		}
+		if err := endpoint.discover(p.baseClient); err != nil {
+			p.logger.Warn(fmt.Sprintf("registry %s unavailable, %s", endpoint.host, err))
+			endpoint.failed.Store(true)
+			lastErr = err
+			continue
+		}
+		req, err := http.NewRequestWithContext(ctx, method, endpoint.url+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			p.logger.Warn(fmt.Sprintf("registry %s unavailable, %s", endpoint.host, err))
+			endpoint.failed.Store(true)
+			lastErr = err
+			continue
+		}
+		if !last && (resp.StatusCode >= http.StatusInternalServerError || (endpoint.mirror &&
+			(resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnauthorized ||
+				resp.StatusCode == http.StatusForbidden))) {
+			resp.Body.Close()
+			p.logger.Info(fmt.Sprintf("registry %s responded %d for %s, fall back to next registry",
+				endpoint.host, resp.StatusCode, path))
+			if resp.StatusCode >= http.StatusInternalServerError {
+				endpoint.failed.Store(true)
+			}
+			lastErr = errors.New(fmt.Sprintf("request %s response code %d", req.URL.String(), resp.StatusCode))
+			continue
+		}
+		return resp, nil
 	}
-	return puller, nil
+	return nil, lastErr
 }
 
-func (p *Puller) DownloadImage(ctx context.Context, finishedCh chan bool) {
+// Pull downloads image and loads it into lxd, the progress is tracked until it returns
+func (p *Puller) Pull(ctx context.Context) (err error) {
+	name := p.reference.String()
+	p.progress.Start(name)
 	defer func() {
-		finishedCh <- true
+		p.progress.Finish(name, err)
 	}()
-	// Delete unused images
-	p.DeleteInvalidImages()
 	isExist := false
-	localDigest := ""
-	remoteDigest := ""
 	if fileutil.Exist(p.imageFolder) {
 		digest := filepath.Join(p.imageFolder, MANIFEST_DIGEST)
 		if fileutil.Exist(digest) {
 			currentDigest, err := util.ReadContent(digest)
 			if err != nil {
-				p.logger.Error(err.Error())
-				return
+				return err
 			}
-			localDigest = currentDigest
 			p.imageDigest, err = p.getImageManifestDigest(ctx)
 			if err != nil {
-				p.logger.Error(err.Error())
-				return
+				return err
 			}
 			if currentDigest == p.imageDigest {
 				p.logger.Info(fmt.Sprintf("image %s:%s unchanged, skip syncing", p.imageName, p.imageTag))
@@ -254,226 +284,347 @@ func (p *Puller) DownloadImage(ctx context.Context, finishedCh chan bool) {
 		}
 	}
 	if !isExist {
-		//create rootfs inside of image folder
-		err := fileutil.CreateDirAll(path.Join(p.imageFolder, ROOTFS_DIR))
-		if err != nil {
-			p.logger.Error(err.Error())
-			return
-		}
-		//create and download images
-		p.logger.Info(fmt.Sprintf("start to download image %s:%s and load into lxd", p.imageName, p.imageTag))
-		blobs, err := p.getImageBlobs(ctx)
-		if err != nil {
-			p.logger.Error(err.Error())
-			return
-		}
-		var wg sync.WaitGroup
-		resChannel := make(chan string, len(blobs))
-		var results []string
-		go func() {
-			for {
-				select {
-				case err, ok := <-resChannel:
-					if !ok {
-						p.logger.Info("blob download channel going to shutdown, task finished")
-						return
-					} else {
-						results = append(results, err)
-					}
-				}
-			}
-		}()
-
-		for i, blob := range blobs {
-			wg.Add(1)
-			index := fmt.Sprintf("[%d/%d]", i+1, len(blobs))
-			go p.downloadBlob(ctx, index, blob, &wg, resChannel)
-		}
-		wg.Wait()
-		close(resChannel)
-		if len(results) != 0 {
-			p.logger.Error(fmt.Sprintf("image %s:%s, (%d/%d) blobs download failed, the first error is %s",
-				p.imageName, p.imageTag, len(results), len(blobs), results[0]))
-			return
-		}
-		//write digest
-		if len(p.imageDigest) == 0 {
-			p.imageDigest, err = p.getImageManifestDigest(ctx)
-			if err != nil {
-				p.logger.Warn(fmt.Sprintf("unable to collect image digest from registry, %s", err.Error()))
-			}
-		}
-
-		if len(p.imageDigest) != 0 {
-			err = util.WriteContent(filepath.Join(p.imageFolder, MANIFEST_DIGEST), p.imageDigest)
-			if err != nil {
-				p.logger.Warn(fmt.Sprintf("unable to write image digest into file %s, %s",
-					filepath.Join(p.imageFolder, MANIFEST_DIGEST), err.Error()))
+		if err = p.downloadImage(ctx); err != nil {
+			//discard partially extracted data, blobs are kept in store
+			if removeErr := os.RemoveAll(p.imageFolder); removeErr != nil {
+				p.logger.Error(removeErr.Error())
 			}
+			return err
 		}
 		p.logger.Info(fmt.Sprintf("download image %s:%s successfully finished", p.imageName, p.imageTag))
 	} else {
 		p.FileNameList = GetFileList(p.imageFolder)
 		p.logger.Info(fmt.Sprintf("Data exists, no need to download repeatedly %s:%s ,successfully finished", p.imageName, p.imageTag))
 	}
-	remoteDigest, _ = p.getImageManifestDigest(ctx)
-	p.logger.Info(fmt.Sprintln("The current digest value is, remoteDigest: ", remoteDigest, ",localDigest: ", localDigest))
-	//load images into lxd
-	err := p.loadLXDImages()
-	if err != nil {
-		p.logger.Error(fmt.Sprintf("Failed to load image %s, %s", p.imageName, p.imageTag))
+	convertedFolder := filepath.Join(p.imageFolder, CONVERTED_DIR)
+	if fileutil.Exist(convertedFolder) {
+		p.converted = true
+		p.FileNameList = GetFileList(convertedFolder)
+	}
+	if p.signatureVerifier != nil {
+		if len(p.indexDigest) == 0 {
+			// digests verified against content when image was downloaded
+			if digests, err := ReadVerifiedDigests(p.imageFolder); err == nil {
+				p.indexDigest, p.manifestDigest = digests.Index, digests.Manifest
+				if len(p.indexDigest) == 0 {
+					p.indexDigest = digests.Manifest
+				}
+			}
+		}
+		if err = p.verifySignature(ctx); err != nil {
+			return errors.New(fmt.Sprintf("signature verification failed, refuse to load, %s", err))
+		}
+	}
+	if isExist && len(p.imageDigest) != 0 {
+		fingerprint, err := p.loadedVersion(p.imageDigest)
+		if err != nil {
+			return err
+		}
+		if len(fingerprint) != 0 {
+			p.alias = p.aliasName()
+			p.fingerprint = fingerprint
+			p.logger.Info(fmt.Sprintf("image %s:%s of digest %s already loaded, alias %s kept", p.imageName,
+				p.imageTag, p.imageDigest, p.alias))
+			return nil
+		}
 	}
-	return
+	//load images into lxd
+	p.progress.SetStatus(name, PULL_STATUS_LOADING)
+	return p.loadLXDImages(ctx)
 }
 
-func (p *Puller) getImageBlobs(ctx context.Context) ([]string, error) {
-	var blobs []string
-	manifest := fmt.Sprintf("%s/%s/manifests/%s", p.registryEndpoint, p.imageName, p.imageTag)
-	reqUrl, err := url.Parse(manifest)
+// downloadImage downloads blobs into blob store, applies them onto rootfs and converts it if required
+func (p *Puller) downloadImage(ctx context.Context) error {
+	name := p.reference.String()
+	//create rootfs inside of image folder
+	err := fileutil.CreateDirAll(path.Join(p.imageFolder, ROOTFS_DIR))
 	if err != nil {
-		return blobs, err
+		return err
 	}
-	req, err := http.NewRequest("GET", reqUrl.String(), nil)
-	req.WithContext(ctx)
+	//create and download images
+	p.logger.Info(fmt.Sprintf("start to download image %s:%s and load into lxd", p.imageName, p.imageTag))
+	blobs, err := p.getImageBlobs(ctx)
 	if err != nil {
-		return blobs, err
+		return err
+	}
+	defer func() {
+		for _, blob := range blobs {
+			p.blobStore.Release(blob)
+		}
+	}()
+	//layers missing in blob store are downloaded concurrently, then applied in order
+	p.progress.SetStatus(name, PULL_STATUS_DOWNLOADING)
+	finished := make(chan bool)
+	go p.logProgress(finished)
+	var wg sync.WaitGroup
+	resChannel := make(chan string, len(blobs))
+	var results []string
+	for i, blob := range blobs {
+		wg.Add(1)
+		index := fmt.Sprintf("[%d/%d]", i+1, len(blobs))
+		go p.downloadBlob(ctx, index, blob, &wg, resChannel)
+	}
+	wg.Wait()
+	close(finished)
+	close(resChannel)
+	for err := range resChannel {
+		results = append(results, err)
+	}
+	if len(results) != 0 {
+		return errors.New(fmt.Sprintf("(%d/%d) blobs download failed, the first error is %s",
+			len(results), len(blobs), results[0]))
+	}
+	p.progress.SetStatus(name, PULL_STATUS_EXTRACTING)
+	applier := newLayerApplier(filepath.Join(p.imageFolder, ROOTFS_DIR), p.logger)
+	for i, blob := range blobs {
+		index := fmt.Sprintf("[%d/%d]", i+1, len(blobs))
+		if err = p.extractBlob(ctx, applier, index, blob); err != nil {
+			return errors.New(fmt.Sprintf("failed to extract blob %s %s, %s", index, blob, err))
+		}
+	}
+	if p.needsConversion() {
+		p.progress.SetStatus(name, PULL_STATUS_CONVERTING)
+		if err = p.convertImage(ctx); err != nil {
+			return errors.New(fmt.Sprintf("failed to convert into lxd image, %s", err))
+		}
+	}
+	p.FileNameList = GetFileList(p.imageFolder)
+	err = WriteVerifiedDigests(p.imageFolder, VerifiedDigests{
+		Index:      p.indexDigest,
+		Manifest:   p.manifestDigest,
+		Layers:     blobs,
+		VerifiedAt: time.Now(),
+	})
+	if err != nil {
+		p.logger.Warn(fmt.Sprintf("unable to record verified digests of image %s:%s, %s",
+			p.imageName, p.imageTag, err))
+	}
+	//write digest computed from the manifest fetched, digest responded by registry afterwards may belong to
+	//another image if tag moved in the meantime
+	p.imageDigest = p.indexDigest
+	if len(p.imageDigest) == 0 {
+		p.imageDigest = p.manifestDigest
+	}
+	if len(p.imageDigest) != 0 {
+		err = util.WriteContent(filepath.Join(p.imageFolder, MANIFEST_DIGEST), p.imageDigest)
+		if err != nil {
+			p.logger.Warn(fmt.Sprintf("unable to write image digest into file %s, %s",
+				filepath.Join(p.imageFolder, MANIFEST_DIGEST), err.Error()))
+		}
+	}
+	return nil
+}
+
+// logProgress logs download progress of image periodically until finished
+func (p *Puller) logProgress(finished chan bool) {
+	ticker := time.NewTicker(PROGRESS_LOG_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-finished:
+			return
+		case <-ticker.C:
+			if progress, ok := p.progress.Get(p.reference.String()); ok {
+				p.logger.Info(fmt.Sprintf("image %s:%s %s", p.imageName, p.imageTag, progress.Summary()))
+			}
+		}
 	}
-	resp, err := httpClient.Do(req)
+}
+
+func (p *Puller) getImageBlobs(ctx context.Context) ([]string, error) {
+	manifest, err := p.getManifest(ctx, p.imageTag)
 	if err != nil {
-		return blobs, err
+		return nil, err
+	}
+	p.indexDigest = ""
+	if !manifest.IsSchema1() {
+		p.indexDigest = manifest.Digest
 	}
-	decoder := json.NewDecoder(resp.Body)
-	if p.registryType == SWRRegistry {
-		var mr SWRManifestResponse
-		if err = decoder.Decode(&mr); err != nil {
-			return blobs, errors.New(fmt.Sprintf("failed to decode swr manifest response: %s", err))
+	if manifest.IsIndex() {
+		architecture, variant := p.getPlatform()
+		digest, err := manifest.SelectPlatform(architecture, variant)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("image %s:%s, %s", p.imageName, p.imageTag, err))
 		}
-		for _, l := range mr.Layers {
-			blobs = append(blobs, l.Digest)
+		p.logger.Info(fmt.Sprintf("manifest %s selected for image %s:%s on platform %s %s",
+			digest, p.imageName, p.imageTag, architecture, variant))
+		if manifest, err = p.getManifest(ctx, digest); err != nil {
+			return nil, err
 		}
-	} else {
-		var dr DockerManifestResponse
-		if err = decoder.Decode(&dr); err != nil {
-			return blobs, errors.New(fmt.Sprintf("failed to decode docker manifest response: %s", err))
+	}
+	p.manifestDigest = manifest.Digest
+	if manifest.Config != nil {
+		p.configDigest = manifest.Config.Digest
+	}
+	blobs := manifest.LayerDigests()
+	for _, blob := range blobs {
+		if err = ValidateDigest(blob); err != nil {
+			return nil, errors.New(fmt.Sprintf("layer of image %s:%s incorrect, %s", p.imageName, p.imageTag, err))
 		}
-		for _, l := range dr.Layers {
-			blobs = append(blobs, l.BlobSum)
+	}
+	descriptors := manifest.Layers
+	if len(descriptors) == 0 {
+		// sizes are not declared in schema1 manifest
+		for _, blob := range blobs {
+			descriptors = append(descriptors, ManifestDescriptor{Digest: blob})
 		}
 	}
+	p.progress.SetBlobs(p.reference.String(), descriptors)
 	return blobs, nil
 }
 
-func (p *Puller) downloadBlob(ctx context.Context, index string, blobID string, wg *sync.WaitGroup, result chan string) {
-	p.logger.Info(fmt.Sprintf(
-		"start to download blob %s %s for image %s:%s", index, blobID, p.imageName, p.imageTag))
-	defer wg.Done()
-	raw := fmt.Sprintf("%s/%s/blobs/%s", strings.TrimRight(p.registryEndpoint,
-		"/"), p.imageName, blobID)
-	reqUrl, err := url.Parse(raw)
-	if err != nil {
-		result <- err.Error()
-		return
-	}
-	req, err := http.NewRequest("GET", reqUrl.String(), nil)
-	req.WithContext(ctx)
+// getManifest fetches image manifest by tag or digest, the content is verified against Docker-Content-Digest
+// header as well as the digest reference.
+func (p *Puller) getManifest(ctx context.Context, reference string) (*ManifestResponse, error) {
+	header := http.Header{}
+	header.Set("Accept", strings.Join(MANIFEST_ACCEPT_TYPES, ", "))
+	resp, err := p.request(ctx, "GET", fmt.Sprintf("/%s/manifests/%s", p.imageName, reference), header)
 	if err != nil {
-		result <- err.Error()
-		return
+		return nil, err
 	}
-	resp, err := httpClient.Do(req)
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		result <- err.Error()
-		return
+		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		buf := new(strings.Builder)
-		_, _ = io.Copy(buf, resp.Body)
-		result <- fmt.Sprintf("request %s response code incorrect expected %d got %d and response %s",
-			reqUrl.String(), http.StatusOK, resp.StatusCode, buf.String())
-		return
+		return nil, errors.New(fmt.Sprintf("request %s response code incorrect expected %d got %d and response %s",
+			resp.Request.URL.String(), http.StatusOK, resp.StatusCode, string(content)))
+	}
+	var manifest ManifestResponse
+	if err = json.Unmarshal(content, &manifest); err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to decode manifest of image %s:%s, %s",
+			p.imageName, reference, err))
+	}
+	manifest.ContentType = strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0])
+	manifest.Digest = sha256Digest(content)
+	if manifest.IsSchema1() {
+		p.logger.Warn(fmt.Sprintf("digest of schema1 manifest of image %s:%s can't be verified",
+			p.imageName, reference))
+		manifest.Digest = resp.Header.Get(DOCKER_CONTENT_DIGEST)
+		return &manifest, nil
+	}
+	expected := []string{resp.Header.Get(DOCKER_CONTENT_DIGEST)}
+	if strings.Contains(reference, ":") {
+		expected = append(expected, reference)
+	}
+	for _, digest := range expected {
+		if len(digest) == 0 {
+			continue
+		}
+		verifier, err := newDigestVerifier(digest)
+		if err != nil {
+			return nil, err
+		}
+		_, _ = verifier.Write(content)
+		if err = verifier.Verify(); err != nil {
+			return nil, errors.New(fmt.Sprintf("manifest of image %s:%s verification failed, %s",
+				p.imageName, reference, err))
+		}
+		manifest.Digest = digest
 	}
-	gReader, err := gzip.NewReader(resp.Body)
+	return &manifest, nil
+}
+
+// getPlatform returns the platform architecture and variant of lxd host
+func (p *Puller) getPlatform() (string, string) {
+	if len(p.architecture) != 0 {
+		return p.architecture, p.variant
+	}
+	kernelArchitecture := ""
+	if p.lxdClient != nil {
+		architecture, err := p.lxdClient.GetArchitecture()
+		if err != nil {
+			p.logger.Warn(fmt.Sprintf("unable to get lxd host architecture, launcher architecture used, %s", err))
+		}
+		kernelArchitecture = architecture
+	}
+	p.architecture, p.variant = PlatformFromKernelArchitecture(kernelArchitecture)
+	return p.architecture, p.variant
+}
+
+// downloadBlob fetches blob into blob store, it's resumed if partially downloaded before
+func (p *Puller) downloadBlob(ctx context.Context, index string, blobID string, wg *sync.WaitGroup, result chan string) {
+	defer wg.Done()
+	if p.blobStore.Exists(blobID) {
+		p.progress.SetCached(p.reference.String(), blobID)
+		p.logger.Info(fmt.Sprintf(
+			"blob %s %s for image %s:%s found in blob store", index, blobID, p.imageName, p.imageTag))
+	} else {
+		p.logger.Info(fmt.Sprintf(
+			"start to download blob %s %s for image %s:%s", index, blobID, p.imageName, p.imageTag))
+	}
+	_, err := p.blobStore.Fetch(ctx, blobID, p.blobFetcher(ctx, blobID))
 	if err != nil {
-		result <- err.Error()
+		result <- fmt.Sprintf("blob %s %s for image %s:%s download failed, %s",
+			index, blobID, p.imageName, p.imageTag, err)
 		return
 	}
-	defer gReader.Close()
-	tr := tar.NewReader(gReader)
-	finished := make(chan bool, 1)
-	defer close(finished)
-	go func() {
-		for {
-			select {
-			case <-finished:
-				return
-			case <-ctx.Done():
-				p.Cancel()
-				return
-			}
+	p.logger.Info(fmt.Sprintf("blob %s %s for image %s:%s verified", index, blobID, p.imageName, p.imageTag))
+}
+
+// blobFetcher requests blob from registry, the content is requested from offset when resuming
+func (p *Puller) blobFetcher(ctx context.Context, blobID string) blobFetcher {
+	return func(offset int64) (*http.Response, error) {
+		header := http.Header{}
+		if offset != 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
 		}
-	}()
-	for {
-		if p.canceled.Load() == true {
-			result <- fmt.Sprintf(
-				"pull image blob %s %s for image %s:%s canceled.", index, blobID, p.imageName, p.imageTag)
-			return
+		resp, err := p.request(ctx, "GET", fmt.Sprintf("/%s/blobs/%s", p.imageName, blobID), header)
+		if err != nil {
+			return nil, err
 		}
-		hdr, err := tr.Next()
-		switch {
-		case err == io.EOF:
-			return
-		case err != nil:
-			result <- err.Error()
-			return
-		case hdr == nil:
-			continue
+		name := p.reference.String()
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			p.progress.SetDownloaded(name, blobID, offset)
+		case http.StatusOK:
+			p.progress.SetDownloaded(name, blobID, 0)
+		default:
+			return resp, nil
 		}
-		dstFileDir := filepath.Join(p.imageFolder, ROOTFS_DIR, hdr.Name)
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if b := fileutil.Exist(dstFileDir); !b {
-				if err := os.MkdirAll(dstFileDir, 0775); err != nil {
-					result <- err.Error()
-					return
-				}
-			}
-		case tar.TypeReg:
-			file, err := os.OpenFile(dstFileDir, os.O_CREATE|os.O_RDWR, os.FileMode(hdr.Mode))
-			if err != nil {
-				result <- err.Error()
-				return
-			}
-			_, err = io.Copy(file, tr)
-			if err != nil {
-				result <- err.Error()
-				return
-			}
-			file.Close()
-			p.FileNameList = append(p.FileNameList, dstFileDir)
+		resp.Body = &progressReader{
+			ctx:     ctx,
+			reader:  resp.Body,
+			limiter: p.limiter,
+			onRead: func(n int64) {
+				p.progress.Add(name, blobID, n)
+			},
 		}
+		return resp, nil
 	}
 }
 
-func (p *Puller) getImageManifestDigest(ctx context.Context) (string, error) {
-	raw := fmt.Sprintf("%s/%s/manifests/%s", strings.TrimRight(p.registryEndpoint,
-		"/"), p.imageName, p.imageTag)
-	p.logger.Info(fmt.Sprintf("start to fetch manifest digest for image %s:%s", p.imageName, p.imageTag))
-	reqUrl, err := url.Parse(raw)
+// extractBlob applies the verified blob in blob store onto rootfs of image folder
+func (p *Puller) extractBlob(ctx context.Context, applier *layerApplier, index string, blobID string) error {
+	p.logger.Info(fmt.Sprintf(
+		"start to extract blob %s %s for image %s:%s", index, blobID, p.imageName, p.imageTag))
+	blobPath, err := p.blobStore.Path(blobID)
 	if err != nil {
-		return "", err
+		return err
 	}
-	req, err := http.NewRequest("HEAD", reqUrl.String(), nil)
-	req.WithContext(ctx)
+	blobFile, err := os.Open(blobPath)
 	if err != nil {
-		return "", err
+		return err
 	}
-	resp, err := httpClient.Do(req)
+	defer blobFile.Close()
+	return applier.Apply(blobFile, func() bool {
+		return p.canceled.Load() || ctx.Err() != nil
+	})
+}
+
+func (p *Puller) getImageManifestDigest(ctx context.Context) (string, error) {
+	p.logger.Info(fmt.Sprintf("start to fetch manifest digest for image %s:%s", p.imageName, p.imageTag))
+	header := http.Header{}
+	header.Set("Accept", strings.Join(MANIFEST_ACCEPT_TYPES, ", "))
+	resp, err := p.request(ctx, "HEAD", fmt.Sprintf("/%s/manifests/%s", p.imageName, p.imageTag), header)
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return "", errors.New(fmt.Sprintf("request %s response code incorrect expected %d got %d",
-			reqUrl.String(), http.StatusOK, resp.StatusCode))
+			resp.Request.URL.String(), http.StatusOK, resp.StatusCode))
 	}
 	digest := resp.Header.Get(DOCKER_CONTENT_DIGEST)
 	if len(digest) == 0 {
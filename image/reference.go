@@ -0,0 +1,96 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	DOCKER_HUB          = "docker.io"
+	DOCKER_HUB_REGISTRY = "registry-1.docker.io"
+	DEFAULT_TAG         = "latest"
+)
+
+// Reference is the parsed image reference in the format of [registry/]repository[:tag][@digest]
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses image reference, registry is docker hub if the first component of name isn't a host,
+// which means it doesn't contain '.' or ':' and isn't localhost.
+func ParseReference(name string) (*Reference, error) {
+	if len(name) == 0 {
+		return nil, errors.New("empty image reference")
+	}
+	ref := &Reference{}
+	remainder := name
+	if index := strings.Index(remainder, "@"); index != -1 {
+		ref.Digest = remainder[index+1:]
+		remainder = remainder[:index]
+		if !strings.Contains(ref.Digest, ":") {
+			return nil, errors.New(fmt.Sprintf("image reference %s has incorrect digest", name))
+		}
+	}
+	components := strings.SplitN(remainder, "/", 2)
+	if len(components) == 2 && (strings.ContainsAny(components[0], ".:") || components[0] == "localhost") {
+		ref.Registry = components[0]
+		remainder = components[1]
+	} else {
+		ref.Registry = DOCKER_HUB
+	}
+	if index := strings.LastIndex(remainder, ":"); index != -1 {
+		ref.Tag = remainder[index+1:]
+		remainder = remainder[:index]
+	}
+	if len(remainder) == 0 || strings.Contains(ref.Tag, "/") {
+		return nil, errors.New(fmt.Sprintf("image reference %s incorrect", name))
+	}
+	if ref.Registry == DOCKER_HUB || ref.Registry == "index.docker.io" || ref.Registry == DOCKER_HUB_REGISTRY {
+		ref.Registry = DOCKER_HUB
+		if !strings.Contains(remainder, "/") {
+			remainder = fmt.Sprintf("library/%s", remainder)
+		}
+	}
+	ref.Repository = remainder
+	if len(ref.Tag) == 0 && len(ref.Digest) == 0 {
+		ref.Tag = DEFAULT_TAG
+	}
+	return ref, nil
+}
+
+// Host returns the registry host the api requests are sent to
+func (r *Reference) Host() string {
+	if r.Registry == DOCKER_HUB {
+		return DOCKER_HUB_REGISTRY
+	}
+	return r.Registry
+}
+
+// Reference returns digest if specified, otherwise tag
+func (r *Reference) Reference() string {
+	if len(r.Digest) != 0 {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// Name returns the last component of repository, for instance nginx of library/nginx
+func (r *Reference) Name() string {
+	components := strings.Split(r.Repository, "/")
+	return components[len(components)-1]
+}
+
+func (r *Reference) String() string {
+	name := fmt.Sprintf("%s/%s", r.Registry, r.Repository)
+	if len(r.Tag) != 0 {
+		name = fmt.Sprintf("%s:%s", name, r.Tag)
+	}
+	if len(r.Digest) != 0 {
+		name = fmt.Sprintf("%s@%s", name, r.Digest)
+	}
+	return name
+}
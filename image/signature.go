@@ -0,0 +1,186 @@
+package image
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+const (
+	// cosign stores signatures of manifest sha256:<hex> in tag sha256-<hex>.sig of the same repository
+	SIGNATURE_TAG_SUFFIX        = ".sig"
+	COSIGN_SIGNATURE_ANNOTATION = "dev.cosignproject.cosign/signature"
+)
+
+// simpleSigning is the signed payload which binds signature to manifest digest
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// SignatureVerifier verifies detached image signatures against the trusted public keys
+type SignatureVerifier struct {
+	keys []crypto.PublicKey
+}
+
+// NewSignatureVerifier loads PEM encoded public keys (ECDSA, RSA or Ed25519), nil is returned if no key files
+// specified which means signature verification is disabled.
+func NewSignatureVerifier(keyFiles []string) (*SignatureVerifier, error) {
+	if len(keyFiles) == 0 {
+		return nil, nil
+	}
+	verifier := &SignatureVerifier{}
+	for _, keyFile := range keyFiles {
+		content, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			var block *pem.Block
+			block, content = pem.Decode(content)
+			if block == nil {
+				break
+			}
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("failed to parse public key in %s, %s", keyFile, err))
+			}
+			verifier.keys = append(verifier.keys, key)
+		}
+	}
+	if len(verifier.keys) == 0 {
+		return nil, errors.New(fmt.Sprintf("no public key found in %s", strings.Join(keyFiles, ",")))
+	}
+	return verifier, nil
+}
+
+// VerifyPayload verifies signature of payload with any of the trusted keys
+func (v *SignatureVerifier) VerifyPayload(payload, signature []byte) error {
+	digest := sha256.Sum256(payload)
+	for _, key := range v.keys {
+		switch k := key.(type) {
+		case *ecdsa.PublicKey:
+			var sig struct {
+				R, S *big.Int
+			}
+			if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+				continue
+			}
+			if ecdsa.Verify(k, digest[:], sig.R, sig.S) {
+				return nil
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil {
+				return nil
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(k, payload, signature) {
+				return nil
+			}
+		}
+	}
+	return errors.New("signature doesn't match any trusted public key")
+}
+
+// SignatureTag returns the tag where signatures of manifest digest are stored
+func SignatureTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + SIGNATURE_TAG_SUFFIX
+}
+
+// verifySignature verifies that the image is signed by trusted keys, signatures of both the tag digest
+// (which could be an index) and the platform manifest digest are accepted. Only digests computed from the
+// manifests fetched are checked, Docker-Content-Digest header is never trusted since it's not tied to the content.
+func (p *Puller) verifySignature(ctx context.Context) error {
+	if len(p.indexDigest) == 0 {
+		return errors.New("manifest digest unknown")
+	}
+	candidates := []string{p.indexDigest}
+	if len(p.manifestDigest) != 0 && p.manifestDigest != p.indexDigest {
+		candidates = append(candidates, p.manifestDigest)
+	}
+	var reasons []string
+	for _, digest := range candidates {
+		err := p.verifyDigestSignature(ctx, digest)
+		if err == nil {
+			p.logger.Info(fmt.Sprintf("signature of image %s:%s verified for digest %s",
+				p.imageName, p.imageTag, digest))
+			return nil
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %s", digest, err))
+	}
+	return errors.New(strings.Join(reasons, "; "))
+}
+
+func (p *Puller) verifyDigestSignature(ctx context.Context, digest string) error {
+	manifest, err := p.getManifest(ctx, SignatureTag(digest))
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to get signature manifest, %s", err))
+	}
+	if len(manifest.Layers) == 0 {
+		return errors.New("no signature found")
+	}
+	var reasons []string
+	for _, layer := range manifest.Layers {
+		encoded, ok := layer.Annotations[COSIGN_SIGNATURE_ANNOTATION]
+		if !ok {
+			continue
+		}
+		err := p.verifySignatureLayer(ctx, digest, layer.Digest, encoded)
+		if err == nil {
+			return nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	if len(reasons) == 0 {
+		return errors.New("no signature annotation found")
+	}
+	return errors.New(strings.Join(reasons, ", "))
+}
+
+func (p *Puller) verifySignatureLayer(ctx context.Context, digest, payloadDigest, encoded string) error {
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return errors.New(fmt.Sprintf("signature incorrect, %s", err))
+	}
+	defer p.blobStore.Release(payloadDigest)
+	payloadPath, err := p.blobStore.Fetch(ctx, payloadDigest, p.blobFetcher(ctx, payloadDigest))
+	if err != nil {
+		return err
+	}
+	payload, err := ioutil.ReadFile(payloadPath)
+	if err != nil {
+		return err
+	}
+	if err = p.signatureVerifier.VerifyPayload(payload, signature); err != nil {
+		return err
+	}
+	var signing simpleSigning
+	if err = json.Unmarshal(payload, &signing); err != nil {
+		return errors.New(fmt.Sprintf("failed to decode signed payload, %s", err))
+	}
+	if signing.Critical.Image.DockerManifestDigest != digest {
+		return errors.New(fmt.Sprintf("signed payload refers to digest %s",
+			signing.Critical.Image.DockerManifestDigest))
+	}
+	return nil
+}
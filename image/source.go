@@ -0,0 +1,331 @@
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"lxc-launcher/lxd"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	SOURCE_HTTP            = "http"
+	SOURCE_FILE            = "file"
+	SOURCE_CONFIGMAP       = "configmap"
+	SOURCE_CUSTOM_RESOURCE = "custom-resource"
+	// interval between two checks of image list file
+	FILE_POLL_INTERVAL = 5 * time.Second
+	// interval before watching kubernetes object again after watch failed or closed
+	WATCH_RETRY_INTERVAL = 10 * time.Second
+	// key of configmap used when configmap contains more than one key and key not specified
+	DEFAULT_CONFIGMAP_KEY = "images.yaml"
+	// field of custom resource which contains the image metadata
+	CUSTOM_RESOURCE_FIELD = "spec"
+	REQUEST_TIMEOUT       = 10 * time.Second
+)
+
+// ImageSource provides the image list declared in image metadata
+type ImageSource interface {
+	// Images returns the latest image list
+	Images(ctx context.Context) ([]ImageDetail, error)
+	// Watch calls notify when image list changed until ctx done, it returns immediately if source doesn't
+	// support watching, in which case image list is only refreshed periodically.
+	Watch(ctx context.Context, notify func())
+}
+
+// NewImageSource creates image source with location, the location format depends on source type:
+//
+//	http: url of metadata endpoint
+//	file: path of yaml or json file
+//	configmap: <namespace>/<name>[/<key>]
+//	custom-resource: <group>/<version>/<resource>/<namespace>/<name>, metadata is read from spec
+func NewImageSource(sourceType, location string, logger *zap.Logger) (ImageSource, error) {
+	if len(location) == 0 {
+		return nil, errors.New(fmt.Sprintf("location of %s image source is required", sourceType))
+	}
+	switch sourceType {
+	case "", SOURCE_HTTP:
+		if _, err := url.Parse(location); err != nil {
+			return nil, err
+		}
+		return &httpSource{endpoint: location, logger: logger}, nil
+	case SOURCE_FILE:
+		return &fileSource{path: location, logger: logger}, nil
+	case SOURCE_CONFIGMAP:
+		components := strings.Split(location, "/")
+		if len(components) != 2 && len(components) != 3 {
+			return nil, errors.New(fmt.Sprintf("configmap %s incorrect, expected <namespace>/<name>[/<key>]",
+				location))
+		}
+		config, err := kubernetesConfig()
+		if err != nil {
+			return nil, err
+		}
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		source := &configMapSource{client: clientset, namespace: components[0], name: components[1],
+			logger: logger}
+		if len(components) == 3 {
+			source.key = components[2]
+		}
+		return source, nil
+	case SOURCE_CUSTOM_RESOURCE:
+		components := strings.Split(location, "/")
+		if len(components) != 5 {
+			return nil, errors.New(fmt.Sprintf(
+				"custom resource %s incorrect, expected <group>/<version>/<resource>/<namespace>/<name>", location))
+		}
+		config, err := kubernetesConfig()
+		if err != nil {
+			return nil, err
+		}
+		client, err := dynamic.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return &customResourceSource{
+			client: client,
+			resource: schema.GroupVersionResource{
+				Group:    components[0],
+				Version:  components[1],
+				Resource: components[2],
+			},
+			namespace: components[3],
+			name:      components[4],
+			logger:    logger,
+		}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported image source %s", sourceType))
+}
+
+// kubernetesConfig uses in cluster config, the kubeconfig in POD_CONFIG environment is used outside of cluster
+func kubernetesConfig() (*rest.Config, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return lxd.GetResConfig("conf")
+	}
+	return config, nil
+}
+
+// ParseImageList parses image metadata in yaml or json
+func ParseImageList(content []byte, logger *zap.Logger) ([]ImageDetail, error) {
+	converted, err := yaml.YAMLToJSON(content)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("failed to decode image list, %s", err))
+	}
+	return ParseImageMetadata(converted, logger)
+}
+
+// httpSource fetches image list from metadata endpoint, the last list is reused when endpoint responds not
+// modified for the ETag.
+type httpSource struct {
+	endpoint string
+	logger   *zap.Logger
+	mutex    sync.Mutex
+	etag     string
+	images   []ImageDetail
+}
+
+func (s *httpSource) Images(ctx context.Context) ([]ImageDetail, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, REQUEST_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", s.endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.etag) != 0 {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		s.logger.Debug(fmt.Sprintf("image list of %s not modified", s.endpoint))
+		return s.images, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("request %s response code incorrect expected %d got %d",
+			s.endpoint, http.StatusOK, resp.StatusCode))
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	images, err := ParseImageList(content, s.logger)
+	if err != nil {
+		return nil, err
+	}
+	s.etag = resp.Header.Get("ETag")
+	s.images = images
+	return images, nil
+}
+
+func (s *httpSource) Watch(ctx context.Context, notify func()) {
+}
+
+// fileSource reads image list from local file, the file is polled for changes since it's usually mounted from
+// configmap where the file is replaced via symlink.
+type fileSource struct {
+	path   string
+	logger *zap.Logger
+}
+
+func (s *fileSource) Images(ctx context.Context) ([]ImageDetail, error) {
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseImageList(content, s.logger)
+}
+
+func (s *fileSource) Watch(ctx context.Context, notify func()) {
+	ticker := time.NewTicker(FILE_POLL_INTERVAL)
+	defer ticker.Stop()
+	var modTime time.Time
+	var size int64
+	if info, err := os.Stat(s.path); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(s.path)
+			if err != nil {
+				s.logger.Warn(fmt.Sprintf("unable to check image list file %s, %s", s.path, err))
+				continue
+			}
+			if info.ModTime().Equal(modTime) && info.Size() == size {
+				continue
+			}
+			modTime, size = info.ModTime(), info.Size()
+			s.logger.Info(fmt.Sprintf("image list file %s changed", s.path))
+			notify()
+		}
+	}
+}
+
+// configMapSource reads image list from key of configmap
+type configMapSource struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	key       string
+	logger    *zap.Logger
+}
+
+func (s *configMapSource) Images(ctx context.Context) ([]ImageDetail, error) {
+	ctx, cancel := context.WithTimeout(ctx, REQUEST_TIMEOUT)
+	defer cancel()
+	configMap, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	key := s.key
+	if len(key) == 0 {
+		key = DEFAULT_CONFIGMAP_KEY
+		if len(configMap.Data) == 1 {
+			for k := range configMap.Data {
+				key = k
+			}
+		}
+	}
+	content, ok := configMap.Data[key]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("key %s not found in configmap %s/%s", key, s.namespace, s.name))
+	}
+	return ParseImageList([]byte(content), s.logger)
+}
+
+func (s *configMapSource) Watch(ctx context.Context, notify func()) {
+	watchObject(ctx, fmt.Sprintf("configmap %s/%s", s.namespace, s.name), s.logger,
+		func(options v1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", s.name).String()
+			return s.client.CoreV1().ConfigMaps(s.namespace).Watch(ctx, options)
+		}, notify)
+}
+
+// customResourceSource reads image list from spec of custom resource
+type customResourceSource struct {
+	client    dynamic.Interface
+	resource  schema.GroupVersionResource
+	namespace string
+	name      string
+	logger    *zap.Logger
+}
+
+func (s *customResourceSource) Images(ctx context.Context) ([]ImageDetail, error) {
+	ctx, cancel := context.WithTimeout(ctx, REQUEST_TIMEOUT)
+	defer cancel()
+	object, err := s.client.Resource(s.resource).Namespace(s.namespace).Get(ctx, s.name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	spec, ok := object.Object[CUSTOM_RESOURCE_FIELD]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%s not found in %s %s/%s", CUSTOM_RESOURCE_FIELD,
+			s.resource.Resource, s.namespace, s.name))
+	}
+	content, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	return ParseImageMetadata(content, s.logger)
+}
+
+func (s *customResourceSource) Watch(ctx context.Context, notify func()) {
+	watchObject(ctx, fmt.Sprintf("%s %s/%s", s.resource.Resource, s.namespace, s.name), s.logger,
+		func(options v1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", s.name).String()
+			return s.client.Resource(s.resource).Namespace(s.namespace).Watch(ctx, options)
+		}, notify)
+}
+
+// watchObject watches kubernetes object and calls notify when it's added or modified, the watch is established
+// again when closed by server.
+func watchObject(ctx context.Context, object string, logger *zap.Logger,
+	watchFunc func(options v1.ListOptions) (watch.Interface, error), notify func()) {
+	for {
+		watcher, err := watchFunc(v1.ListOptions{})
+		if err != nil {
+			logger.Warn(fmt.Sprintf("unable to watch %s, %s", object, err))
+		} else {
+			for event := range watcher.ResultChan() {
+				if event.Type == watch.Added || event.Type == watch.Modified {
+					logger.Info(fmt.Sprintf("%s changed", object))
+					notify()
+				}
+			}
+			watcher.Stop()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(WATCH_RETRY_INTERVAL):
+		}
+	}
+}
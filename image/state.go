@@ -0,0 +1,214 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// state file kept inside of data folder
+	SYNC_STATE_FILE     = "sync-state.json"
+	SYNC_STATUS_PENDING = "pending"
+	SYNC_STATUS_SYNCED  = "synced"
+	SYNC_STATUS_FAILED  = "failed"
+)
+
+// ImageState is the sync state of image declared in image list
+type ImageState struct {
+	// identifies image declared in image list
+	Key         string     `json:"key"`
+	Name        string     `json:"name"`
+	Type        string     `json:"type,omitempty"`
+	Alias       string     `json:"alias,omitempty"`
+	Status      string     `json:"status"`
+	Digest      string     `json:"digest,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	// error of the last failed sync, cleared once synced
+	Error string `json:"error,omitempty"`
+}
+
+// SyncState is the sync state of all images on node
+type SyncState struct {
+	Node      string       `json:"node"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+	Images    []ImageState `json:"images"`
+}
+
+// StateStore records sync state of images and persists it as json file, so that state survives restarts.
+type StateStore struct {
+	path   string
+	node   string
+	mutex  sync.Mutex
+	images map[string]*ImageState
+}
+
+// NewStateStore creates state store with state file inside of data folder, the existing state is loaded and
+// state is recorded from scratch if it can't be loaded.
+func NewStateStore(dataFolder string, logger *zap.Logger) *StateStore {
+	node, err := os.Hostname()
+	if err != nil {
+		logger.Warn(fmt.Sprintf("unable to get node name for sync state, %s", err))
+	}
+	s := &StateStore{
+		path:   filepath.Join(dataFolder, SYNC_STATE_FILE),
+		node:   node,
+		images: map[string]*ImageState{},
+	}
+	state, err := ReadSyncState(dataFolder)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn(fmt.Sprintf("unable to load sync state, %s", err))
+		}
+		return s
+	}
+	for i := range state.Images {
+		s.images[state.Images[i].Key] = &state.Images[i]
+	}
+	return s
+}
+
+// ReadSyncState reads sync state persisted in data folder
+func ReadSyncState(dataFolder string) (*SyncState, error) {
+	content, err := ioutil.ReadFile(filepath.Join(dataFolder, SYNC_STATE_FILE))
+	if err != nil {
+		return nil, err
+	}
+	var state SyncState
+	if err = json.Unmarshal(content, &state); err != nil {
+		return nil, errors.New(fmt.Sprintf("sync state file %s incorrect, %s", SYNC_STATE_FILE, err))
+	}
+	return &state, nil
+}
+
+// Declare updates state with the latest image list, images not synced yet are pending and images removed from
+// list are dropped.
+func (s *StateStore) Declare(details []ImageDetail) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	declared := map[string]bool{}
+	for _, detail := range details {
+		key := detail.key()
+		declared[key] = true
+		if _, ok := s.images[key]; !ok {
+			s.images[key] = &ImageState{
+				Key:    key,
+				Name:   detail.reference(),
+				Type:   detail.Type,
+				Alias:  detail.Alias,
+				Status: SYNC_STATUS_PENDING,
+			}
+		}
+	}
+	for key := range s.images {
+		if !declared[key] {
+			delete(s.images, key)
+		}
+	}
+	return s.save()
+}
+
+// Succeed records image synced into lxd
+func (s *StateStore) Succeed(detail ImageDetail, alias, digest, fingerprint string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	state := s.get(detail)
+	state.Status = SYNC_STATUS_SYNCED
+	state.Alias = alias
+	state.Digest = digest
+	state.Fingerprint = fingerprint
+	state.LastSuccess = &now
+	state.Error = ""
+	return s.save()
+}
+
+// Fail records the error of image sync, the last synced digest and fingerprint are kept
+func (s *StateStore) Fail(detail ImageDetail, syncErr error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	state := s.get(detail)
+	state.Status = SYNC_STATUS_FAILED
+	state.LastFailure = &now
+	state.Error = syncErr.Error()
+	return s.save()
+}
+
+// State returns the sync state of all images sorted by name and then alias
+func (s *StateStore) State() SyncState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state()
+}
+
+// Handler serves sync state in json, images are filtered by status when status query specified
+func (s *StateStore) Handler(w http.ResponseWriter, req *http.Request) {
+	state := s.State()
+	if status := req.URL.Query().Get("status"); len(status) != 0 {
+		images := []ImageState{}
+		for _, image := range state.Images {
+			if image.Status == status {
+				images = append(images, image)
+			}
+		}
+		state.Images = images
+	}
+	content, err := json.Marshal(state)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(fmt.Sprintf("failed to encode sync state, %s", err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
+
+func (s *StateStore) get(detail ImageDetail) *ImageState {
+	key := detail.key()
+	state, ok := s.images[key]
+	if !ok {
+		state = &ImageState{Key: key, Name: detail.reference(), Type: detail.Type, Alias: detail.Alias}
+		s.images[key] = state
+	}
+	return state
+}
+
+func (s *StateStore) state() SyncState {
+	state := SyncState{Node: s.node, UpdatedAt: time.Now(), Images: make([]ImageState, 0, len(s.images))}
+	for _, image := range s.images {
+		state.Images = append(state.Images, *image)
+	}
+	sort.Slice(state.Images, func(i, j int) bool {
+		if state.Images[i].Name != state.Images[j].Name {
+			return state.Images[i].Name < state.Images[j].Name
+		}
+		return state.Images[i].Key < state.Images[j].Key
+	})
+	return state
+}
+
+// save writes state into a temporary file and renames it, so that state file is never partially written
+func (s *StateStore) save() error {
+	content, err := json.MarshalIndent(s.state(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tempFile := s.path + ".tmp"
+	if err = ioutil.WriteFile(tempFile, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, s.path)
+}
@@ -0,0 +1,55 @@
+package image
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// newRegistryTransport creates transport with proxy and CA bundle specified in options
+func newRegistryTransport(options RegistryOptions) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(options.Proxy) != 0 {
+		proxy, err := url.Parse(options.Proxy)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("registry proxy %s incorrect, %s", options.Proxy, err))
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if len(options.CABundle) != 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		content, err := ioutil.ReadFile(options.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, errors.New(fmt.Sprintf("no certificate found in CA bundle %s", options.CABundle))
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return transport, nil
+}
+
+// ParseRegistryMirrors parses mirrors in the format of <registry-host>=<mirror>, mirrors of the same host are
+// kept in order, for instance docker.io=https://mirror.example.com
+func ParseRegistryMirrors(values []string) (map[string][]string, error) {
+	mirrors := map[string][]string{}
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+			return nil, errors.New(fmt.Sprintf("registry mirror %s incorrect, expected <registry-host>=<mirror>",
+				value))
+		}
+		host := strings.TrimSpace(parts[0])
+		mirrors[host] = append(mirrors[host], strings.TrimRight(strings.TrimSpace(parts[1]), "/"))
+	}
+	return mirrors, nil
+}
@@ -0,0 +1,200 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lxc/lxd/shared/api"
+	"go.uber.org/zap"
+	"lxc-launcher/lxd"
+)
+
+const (
+	// versioned alias is in the format of <alias>@<digest-short>
+	VERSION_ALIAS_SEPARATOR = "@"
+	VERSION_DIGEST_LENGTH   = 12
+	// versions retained for images which keep previous versions
+	DEFAULT_IMAGE_RETAIN = 3
+)
+
+// ImageVersion is one version of image alias, which is kept via versioned alias
+type ImageVersion struct {
+	Alias       string    `json:"alias"`
+	Version     string    `json:"version"`
+	Fingerprint string    `json:"fingerprint"`
+	UploadedAt  time.Time `json:"uploadedAt"`
+	// whether the image alias points to this version
+	Current bool `json:"current"`
+}
+
+// VersionAlias returns the versioned alias of image digest
+func VersionAlias(alias, digest string) string {
+	version := digest
+	if index := strings.Index(version, ":"); index != -1 {
+		version = version[index+1:]
+	}
+	if len(version) > VERSION_DIGEST_LENGTH {
+		version = version[:VERSION_DIGEST_LENGTH]
+	}
+	return alias + VERSION_ALIAS_SEPARATOR + version
+}
+
+// ListImageVersions returns versions of image alias from the newest to the oldest
+func ListImageVersions(client *lxd.Client, alias string) ([]ImageVersion, error) {
+	entries, err := client.GetImageAliases()
+	if err != nil {
+		return nil, err
+	}
+	current := ""
+	for _, entry := range entries {
+		if entry.Name == alias {
+			current = entry.Target
+		}
+	}
+	prefix := alias + VERSION_ALIAS_SEPARATOR
+	uploaded := map[string]time.Time{}
+	var versions []ImageVersion
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name, prefix) {
+			continue
+		}
+		if _, ok := uploaded[entry.Target]; !ok {
+			image, err := client.GetImage(entry.Target)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("unable to get image %s of alias %s, %s", entry.Target,
+					entry.Name, err))
+			}
+			uploaded[entry.Target] = image.UploadedAt
+		}
+		versions = append(versions, ImageVersion{
+			Alias:       entry.Name,
+			Version:     strings.TrimPrefix(entry.Name, prefix),
+			Fingerprint: entry.Target,
+			UploadedAt:  uploaded[entry.Target],
+			Current:     entry.Target == current,
+		})
+	}
+	sortImageVersions(versions)
+	return versions, nil
+}
+
+func sortImageVersions(versions []ImageVersion) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		if !versions[i].UploadedAt.Equal(versions[j].UploadedAt) {
+			return versions[i].UploadedAt.After(versions[j].UploadedAt)
+		}
+		return versions[i].Alias < versions[j].Alias
+	})
+}
+
+// PruneImageVersions removes versioned aliases exceeding retain, images without any alias left are deleted
+// as invalid images afterwards.
+func PruneImageVersions(client *lxd.Client, alias string, retain int, logger *zap.Logger) error {
+	versions, err := ListImageVersions(client, alias)
+	if err != nil {
+		return err
+	}
+	for _, version := range staleImageVersions(versions, retain) {
+		if err = client.DeleteImageAlias(version.Alias); err != nil {
+			return err
+		}
+		logger.Info(fmt.Sprintf("version %s of image %s removed", version.Alias, version.Fingerprint))
+	}
+	return nil
+}
+
+// staleImageVersions returns versions which are neither current nor the newest retain versions
+func staleImageVersions(versions []ImageVersion, retain int) []ImageVersion {
+	kept := map[string]bool{}
+	for _, version := range versions {
+		if version.Current {
+			kept[version.Fingerprint] = true
+		}
+	}
+	var stale []ImageVersion
+	for _, version := range versions {
+		if kept[version.Fingerprint] {
+			continue
+		}
+		if len(kept) < retain {
+			kept[version.Fingerprint] = true
+			continue
+		}
+		stale = append(stale, version)
+	}
+	return stale
+}
+
+// RollbackImage points image alias to the specified version, the version right before the current one is used
+// when version is empty.
+func RollbackImage(client *lxd.Client, alias, version string) (*ImageVersion, error) {
+	versions, err := ListImageVersions(client, alias)
+	if err != nil {
+		return nil, err
+	}
+	target, err := rollbackTarget(versions, alias, version)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.UpdateImageAlias(alias, target.Fingerprint); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+func rollbackTarget(versions []ImageVersion, alias, version string) (*ImageVersion, error) {
+	if len(version) != 0 {
+		for i := range versions {
+			if versions[i].Version == version || versions[i].Alias == version ||
+				strings.HasPrefix(versions[i].Fingerprint, version) {
+				if versions[i].Current {
+					return nil, errors.New(fmt.Sprintf("image %s is already at version %s", alias, version))
+				}
+				return &versions[i], nil
+			}
+		}
+		return nil, errors.New(fmt.Sprintf("version %s of image %s not found", version, alias))
+	}
+	current := -1
+	for i := range versions {
+		if versions[i].Current {
+			current = i
+		}
+	}
+	if current == -1 {
+		return nil, errors.New(fmt.Sprintf("current version of image %s not found", alias))
+	}
+	for i := current + 1; i < len(versions); i++ {
+		if versions[i].Fingerprint != versions[current].Fingerprint {
+			return &versions[i], nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("no previous version of image %s to roll back to", alias))
+}
+
+// ResolveImage returns image which alias points to, name is used as fingerprint or its prefix when alias not
+// found. nil is returned when image not found.
+func ResolveImage(client *lxd.Client, name string) (*api.Image, error) {
+	entries, err := client.GetImageAliases()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Name == name {
+			name = entry.Target
+			break
+		}
+	}
+	image, err := client.GetImage(name)
+	if err != nil {
+		if api.StatusErrorCheck(err, http.StatusNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return image, nil
+}
@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -37,18 +38,65 @@ const (
 	DEL_STOPPED_TIME = 6 * 3600
 )
 
+const (
+	INSTANCE_CONTAINER = "container"
+	INSTANCE_VM        = "virtual-machine"
+	// instance config which records fingerprint of the image instance created from
+	CONFIG_BASE_IMAGE = "volatile.base_image"
+)
+
+// ONLINE_GROW_DRIVERS are storage drivers which support growing root disk of running instance
+var ONLINE_GROW_DRIVERS = map[string]bool{
+	"zfs":   true,
+	"btrfs": true,
+	"lvm":   true,
+	"ceph":  true,
+}
+
 type ResourceLimit struct {
 	Device string
 	Name   string
 	Value  string
 }
 
+// ResourceSpec is the resource limitation of lxd instance, empty field will be skipped
+type ResourceSpec struct {
+	InstanceType     string
+	DeviceName       string
+	StoragePool      string
+	RootSize         string
+	DiskRead         string
+	DiskWrite        string
+	DiskPriority     string
+	Ingress          string
+	Egress           string
+	CPU              string
+	CPUPinning       string
+	Memory           string
+	MemorySwap       string
+	MemoryEnforce    string
+	Hugepages        []string
+	Processes        string
+	AdditionalConfig []string
+}
+
 type Client struct {
 	instServer   lxd.InstanceServer
 	imageServer  lxd.ImageServer
 	logger       *zap.Logger
 	DeviceLimits map[string]map[string]string
 	Configs      map[string]string
+	// serializes resizing of instances
+	resizeMutex sync.Mutex
+}
+
+// InvalidLimitError is returned when the resource limitation requested can't be applied onto instance
+type InvalidLimitError struct {
+	message string
+}
+
+func (e *InvalidLimitError) Error() string {
+	return e.message
 }
 
 func NewClient(socket, server, clientKeyPath, clientSecretPath string, logger *zap.Logger) (*Client, error) {
@@ -87,102 +135,128 @@ func NewClient(socket, server, clientKeyPath, clientSecretPath string, logger *z
 	}, nil
 }
 
-func (c *Client) ValidateResourceLimit(egressLimit, ingressLimit, rootSize, storagePool, memoryResource,
-	cpuResource string, additionalConfig []string, deviceName string, processLimit string, instanceType string) error {
+func (c *Client) ValidateResourceLimit(spec ResourceSpec) error {
 	//egress limitation
-	c.DeviceLimits[deviceName] = map[string]string{}
-	if len(egressLimit) != 0 {
-		if strings.HasSuffix(egressLimit, "kbit") || strings.HasSuffix(
-			egressLimit, "Mbit") || strings.HasSuffix(
-			egressLimit, "Gbit") || strings.HasSuffix(egressLimit, "Tbit") {
-			c.DeviceLimits[deviceName]["limits.egress"] = egressLimit
-		} else if strings.HasSuffix(egressLimit, "k") || strings.HasSuffix(
-			egressLimit, "M") || strings.HasSuffix(
-			egressLimit, "G") || strings.HasSuffix(egressLimit, "T") {
-			c.DeviceLimits[deviceName]["limits.egress"] = fmt.Sprintf("%sbit", egressLimit)
-		} else {
-			return errors.New(fmt.Sprintf(
-				"instance network egress limitation %s incorrect, only support（M|G|T)bit or（M|G|T)", egressLimit))
+	if len(spec.Egress) != 0 || len(spec.Ingress) != 0 {
+		c.DeviceLimits[spec.DeviceName] = map[string]string{}
+	}
+	if len(spec.Egress) != 0 {
+		egress, err := ParseBandwidthLimit(spec.Egress)
+		if err != nil {
+			return errors.New(fmt.Sprintf("instance network egress limitation incorrect, %s", err))
 		}
+		c.DeviceLimits[spec.DeviceName]["limits.egress"] = egress
 	}
 	//ingress limitation
-	if len(ingressLimit) != 0 {
-		if strings.HasSuffix(egressLimit, "kbit") || strings.HasSuffix(
-			ingressLimit, "Mbit") || strings.HasSuffix(
-			ingressLimit, "Gbit") || strings.HasSuffix(ingressLimit, "Tbit") {
-			c.DeviceLimits[deviceName]["limits.ingress"] = ingressLimit
-		} else if strings.HasSuffix(egressLimit, "k") || strings.HasSuffix(
-			ingressLimit, "M") || strings.HasSuffix(
-			ingressLimit, "G") || strings.HasSuffix(ingressLimit, "T") {
-			c.DeviceLimits[deviceName]["limits.ingress"] = fmt.Sprintf("%sbit", ingressLimit)
-		} else {
-			return errors.New(fmt.Sprintf(
-				"instance network ingress limitation %s incorrect, only support（M|G|T)bit or（M|G|T)", ingressLimit))
+	if len(spec.Ingress) != 0 {
+		ingress, err := ParseBandwidthLimit(spec.Ingress)
+		if err != nil {
+			return errors.New(fmt.Sprintf("instance network ingress limitation incorrect, %s", err))
 		}
+		c.DeviceLimits[spec.DeviceName]["limits.ingress"] = ingress
 	}
 	//root size
-	c.DeviceLimits["root"] = map[string]string{}
-	if len(rootSize) != 0 {
-		if strings.HasSuffix(rootSize, "MB") || strings.HasSuffix(
-			rootSize, "GB") || strings.HasSuffix(rootSize, "TB") ||
-			strings.HasSuffix(rootSize, "MiB") || strings.HasSuffix(
-			rootSize, "GiB") || strings.HasSuffix(rootSize, "TiB") {
-			c.DeviceLimits["root"]["size"] = rootSize
-			c.DeviceLimits["root"]["pool"] = storagePool
-			c.DeviceLimits["root"]["type"] = "disk"
-			c.DeviceLimits["root"]["path"] = "/"
-		} else if strings.HasSuffix(rootSize, "Mi") || strings.HasSuffix(
-			rootSize, "Gi") || strings.HasSuffix(rootSize, "Ti") {
-			c.DeviceLimits["root"]["size"] = fmt.Sprintf("%sB", rootSize)
-			c.DeviceLimits["root"]["pool"] = storagePool
-			c.DeviceLimits["root"]["type"] = "disk"
-			c.DeviceLimits["root"]["path"] = "/"
-		} else {
+	if len(spec.RootSize) != 0 {
+		size, err := ParseDiskSize(spec.RootSize)
+		if err != nil {
+			return errors.New(fmt.Sprintf("instance storage size limitation incorrect, %s", err))
+		}
+		c.rootDevice(spec.StoragePool)["size"] = size
+	}
+	//root disk io limitation
+	if len(spec.DiskRead) != 0 {
+		read, err := ParseDiskIOLimit(spec.DiskRead)
+		if err != nil {
+			return errors.New(fmt.Sprintf("instance disk read limitation incorrect, %s", err))
+		}
+		c.rootDevice(spec.StoragePool)["limits.read"] = read
+	}
+	if len(spec.DiskWrite) != 0 {
+		write, err := ParseDiskIOLimit(spec.DiskWrite)
+		if err != nil {
+			return errors.New(fmt.Sprintf("instance disk write limitation incorrect, %s", err))
+		}
+		c.rootDevice(spec.StoragePool)["limits.write"] = write
+	}
+	if len(spec.DiskPriority) != 0 {
+		priority, err := strconv.Atoi(spec.DiskPriority)
+		if err != nil || priority < 0 || priority > 10 {
 			return errors.New(fmt.Sprintf(
-				"instance storage size limitation %s incorrect, only support（M|G|T)iB or（M|G|T)B", rootSize))
+				"instance disk priority %s incorrect, must be an integer between 0 and 10", spec.DiskPriority))
 		}
+		c.Configs["limits.disk.priority"] = strconv.Itoa(priority)
 	}
 	//memory limitation
-	if len(memoryResource) != 0 {
-		if strings.HasSuffix(memoryResource, "MB") || strings.HasSuffix(
-			memoryResource, "GB") || strings.HasSuffix(memoryResource, "TB") ||
-			strings.HasSuffix(memoryResource, "MiB") || strings.HasSuffix(
-			memoryResource, "GiB") || strings.HasSuffix(memoryResource, "TiB") {
-			c.Configs["limits.memory"] = memoryResource
-		} else if strings.HasSuffix(memoryResource, "Mi") || strings.HasSuffix(
-			memoryResource, "Gi") || strings.HasSuffix(memoryResource, "Ti") {
-			c.Configs["limits.memory"] = fmt.Sprintf("%sB", memoryResource)
-		} else {
+	if len(spec.Memory) != 0 {
+		memory, err := ParseMemoryLimit(spec.Memory)
+		if err != nil {
+			return errors.New(fmt.Sprintf("instance memory limitation incorrect, %s", err))
+		}
+		c.Configs["limits.memory"] = memory
+	}
+	if len(spec.MemorySwap) != 0 {
+		if spec.InstanceType != INSTANCE_CONTAINER {
+			return errors.New("instance memory swap limitation only supported on container")
+		}
+		swap, err := strconv.ParseBool(spec.MemorySwap)
+		if err != nil {
+			return errors.New(fmt.Sprintf("instance memory swap %s incorrect, must be true or false", spec.MemorySwap))
+		}
+		c.Configs["limits.memory.swap"] = strconv.FormatBool(swap)
+	}
+	if len(spec.MemoryEnforce) != 0 {
+		if spec.InstanceType != INSTANCE_CONTAINER {
+			return errors.New("instance memory enforce only supported on container")
+		}
+		if spec.MemoryEnforce != "hard" && spec.MemoryEnforce != "soft" {
 			return errors.New(fmt.Sprintf(
-				"instance memory limitation %s incorrect, only support（M|G|T)iB or（M|G|T)B", memoryResource))
+				"instance memory enforce %s incorrect, only support hard or soft", spec.MemoryEnforce))
 		}
+		c.Configs["limits.memory.enforce"] = spec.MemoryEnforce
+	}
+	//hugepages limitation, in the format of <page-size>=<limit>
+	for _, h := range spec.Hugepages {
+		if len(h) == 0 {
+			continue
+		}
+		if spec.InstanceType != INSTANCE_CONTAINER {
+			return errors.New("instance hugepages limitation only supported on container")
+		}
+		key, value, err := ParseHugepagesLimit(h)
+		if err != nil {
+			return errors.New(fmt.Sprintf("instance hugepages limitation incorrect, %s", err))
+		}
+		c.Configs[key] = value
 	}
 	//cpu limitation
-	if len(cpuResource) != 0 {
-		if strings.HasSuffix(cpuResource, "%") {
-			c.Configs["limits.cpu"] = "1"
-			c.Configs["limits.cpu.allowance"] = cpuResource
-		} else {
-			core, err := strconv.ParseFloat(cpuResource, 64)
-			if err != nil {
-				return err
-			}
-			if core >= 1 {
-				c.Configs["limits.cpu"] = fmt.Sprintf("%d", int(core))
-			} else if core < 1 && core > 0 {
-				c.Configs["limits.cpu"] = "1"
-				c.Configs["limits.cpu.allowance"] = fmt.Sprintf("%0.0f%%", float64(core)*100)
-			} else {
-				return errors.New("cpu core must be greater than 0")
-			}
+	if len(spec.CPU) != 0 {
+		cpu, allowance, err := ParseCPULimit(spec.CPU)
+		if err != nil {
+			return errors.New(fmt.Sprintf("instance cpu limitation incorrect, %s", err))
+		}
+		c.Configs["limits.cpu"] = cpu
+		if len(allowance) != 0 {
+			c.Configs["limits.cpu.allowance"] = allowance
+		}
+	}
+	//cpu pinning, overrides cpu count while allowance is kept
+	if len(spec.CPUPinning) != 0 {
+		cpus, cpuSet, err := ParseCPUSet(spec.CPUPinning)
+		if err != nil {
+			return errors.New(fmt.Sprintf("instance cpu pinning incorrect, %s", err))
+		}
+		if cores, err := strconv.Atoi(c.Configs["limits.cpu"]); err == nil && cores > cpus {
+			return errors.New(fmt.Sprintf(
+				"instance cpu limitation %s exceeds %d pinned cpus %s", spec.CPU, cpus, spec.CPUPinning))
 		}
+		c.Configs["limits.cpu"] = cpuSet
 	}
 	//apply resource limits on container
-	if instanceType == "container" {
-		c.Configs["limits.processes"] = processLimit
+	if spec.InstanceType == INSTANCE_CONTAINER && len(spec.Processes) != 0 {
+		c.Configs["limits.processes"] = spec.Processes
 	}
 	//additional config, for instance: security.nesting=true
-	for _, a := range additionalConfig {
+	for _, a := range spec.AdditionalConfig {
 		if len(a) != 0 {
 			//value may contains equal symbol
 			arr := strings.SplitN(a, "=", 2)
@@ -204,6 +278,17 @@ func (c *Client) ValidateResourceLimit(egressLimit, ingressLimit, rootSize, stor
 	return nil
 }
 
+func (c *Client) rootDevice(storagePool string) map[string]string {
+	if _, ok := c.DeviceLimits["root"]; !ok {
+		c.DeviceLimits["root"] = map[string]string{
+			"pool": storagePool,
+			"type": "disk",
+			"path": "/",
+		}
+	}
+	return c.DeviceLimits["root"]
+}
+
 func (c *Client) CheckPoolExists(name string) (bool, error) {
 	names, err := c.instServer.GetStoragePoolNames()
 	if err != nil {
@@ -222,13 +307,25 @@ func (c *Client) ApplyResourceLimit(name string, instEnvs []string) error {
 	if err != nil {
 		return err
 	}
+	req := c.BuildInstancePut(instance, instEnvs)
+	c.logger.Info(fmt.Sprintf("perform instance %s resource limit %v", name, req))
+	op, err := c.instServer.UpdateInstance(name, req, etag)
+	if err != nil {
+		return err
+	}
+	return op.Wait()
+}
+
+// BuildInstancePut merges resource limitation and environments into instance config and expanded devices,
+// note the config and devices of instance will be updated in place.
+func (c *Client) BuildInstancePut(instance *api.Instance, instEnvs []string) api.InstancePut {
 	req := api.InstancePut{
-		Config: util.MergeConfigs(instance.Config, c.Configs),
-		Profiles: instance.Profiles,
+		Config:       util.MergeConfigs(instance.Config, c.Configs),
+		Profiles:     instance.Profiles,
 		Architecture: instance.Architecture,
-		Ephemeral: instance.Ephemeral,
-		Stateful: instance.Stateful,
-		Description: instance.Description,
+		Ephemeral:    instance.Ephemeral,
+		Stateful:     instance.Stateful,
+		Description:  instance.Description,
 	}
 	//add environment if needed
 	if len(instEnvs) != 0 {
@@ -239,12 +336,68 @@ func (c *Client) ApplyResourceLimit(name string, instEnvs []string) error {
 	}
 	// Use expanded device for resource update
 	req.Devices = util.MergeDeviceConfigs(instance.ExpandedDevices, c.DeviceLimits)
-	c.logger.Info(fmt.Sprintf("perform instance %s resource limit %v", name, req))
-	op, err := c.instServer.UpdateInstance(name, req, etag)
+	return req
+}
+
+// ResizeInstance applies new resource limitation on running instance, root disk can only be grown
+// when storage driver supports online resizing.
+func (c *Client) ResizeInstance(name string, spec ResourceSpec) error {
+	c.resizeMutex.Lock()
+	defer c.resizeMutex.Unlock()
+	instance, _, err := c.instServer.GetInstance(name)
 	if err != nil {
 		return err
 	}
-	return op.Wait()
+	// limitation is built on its own maps, the ones of client are kept for launching
+	resizer := &Client{
+		instServer:   c.instServer,
+		imageServer:  c.imageServer,
+		logger:       c.logger,
+		Configs:      map[string]string{},
+		DeviceLimits: map[string]map[string]string{},
+	}
+	spec.InstanceType = instance.Type
+	rootDevice := instance.ExpandedDevices["root"]
+	if len(spec.StoragePool) == 0 {
+		spec.StoragePool = rootDevice["pool"]
+	}
+	if err = resizer.ValidateResourceLimit(spec); err != nil {
+		return &InvalidLimitError{message: err.Error()}
+	}
+	if root, ok := resizer.DeviceLimits["root"]; ok && len(root["size"]) != 0 {
+		if err = c.validateRootGrowth(spec.StoragePool, rootDevice["size"], root["size"]); err != nil {
+			return err
+		}
+	}
+	c.logger.Info(fmt.Sprintf("start to resize instance %s", name))
+	return resizer.ApplyResourceLimit(name, nil)
+}
+
+func (c *Client) validateRootGrowth(storagePool, currentSize, newSize string) error {
+	pool, _, err := c.instServer.GetStoragePool(storagePool)
+	if err != nil {
+		return err
+	}
+	if !ONLINE_GROW_DRIVERS[pool.Driver] {
+		return &InvalidLimitError{message: fmt.Sprintf(
+			"storage driver %s of pool %s doesn't support online growing", pool.Driver, storagePool)}
+	}
+	if len(currentSize) == 0 {
+		return nil
+	}
+	current, err := ParseByteSize(currentSize)
+	if err != nil {
+		return err
+	}
+	size, err := ParseByteSize(newSize)
+	if err != nil {
+		return &InvalidLimitError{message: err.Error()}
+	}
+	if size < current {
+		return &InvalidLimitError{message: fmt.Sprintf(
+			"root disk can't be shrunk from %s to %s", currentSize, newSize)}
+	}
+	return nil
 }
 
 func (c *Client) LaunchInstance(name string, instEnvs []string, startCmd string, deviceName string,
@@ -394,6 +547,16 @@ func (c *Client) StopInstance(name string, alsoDelete bool) error {
 }
 
 func (c *Client) CreateInstance(imageAlias string, instanceName string, profiles []string, instType string) error {
+	req := c.BuildInstancesPost(imageAlias, instanceName, profiles, instType)
+	op, err := c.instServer.CreateInstance(req)
+	if err != nil {
+		return err
+	}
+	return op.Wait()
+}
+
+func (c *Client) BuildInstancesPost(imageAlias string, instanceName string, profiles []string,
+	instType string) api.InstancesPost {
 	req := api.InstancesPost{
 		Name: instanceName,
 		Source: api.InstanceSource{
@@ -407,11 +570,15 @@ func (c *Client) CreateInstance(imageAlias string, instanceName string, profiles
 		req.Devices["root"] = c.DeviceLimits["root"]
 	}
 	req.Profiles = profiles
-	op, err := c.instServer.CreateInstance(req)
+	return req
+}
+
+func (c *Client) GetInstance(name string) (*api.Instance, error) {
+	instance, _, err := c.instServer.GetInstance(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return op.Wait()
+	return instance, nil
 }
 
 func (c *Client) CheckImageByAlias(alias string) (bool, error) {
@@ -438,6 +605,31 @@ func (c *Client) CheckManageImageByAlias(alias string) (bool, error) {
 	return false, nil
 }
 
+// GetImageAliases returns all image aliases
+func (c *Client) GetImageAliases() ([]api.ImageAliasesEntry, error) {
+	return c.instServer.GetImageAliases()
+}
+
+// UpdateImageAlias points alias to the image with fingerprint
+func (c *Client) UpdateImageAlias(alias, fingerprint string) error {
+	entry, etag, err := c.instServer.GetImageAlias(alias)
+	if err != nil {
+		return err
+	}
+	put := entry.ImageAliasesEntryPut
+	put.Target = fingerprint
+	return c.instServer.UpdateImageAlias(alias, put, etag)
+}
+
+// GetImage returns image with fingerprint
+func (c *Client) GetImage(fingerprint string) (*api.Image, error) {
+	image, _, err := c.instServer.GetImage(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
 func (c *Client) DeleteImageAlias(alias string) error {
 	delImageErr := c.instServer.DeleteImageAlias(alias)
 	if delImageErr != nil {
@@ -494,6 +686,48 @@ func (c *Client) DeleteImage(fingerprint string) (op cli.Operation, err error) {
 	return
 }
 
+// DeleteImageAndWait deletes image and waits until it's removed from storage pool
+func (c *Client) DeleteImageAndWait(fingerprint string) error {
+	op, err := c.instServer.DeleteImage(fingerprint)
+	if err != nil {
+		return err
+	}
+	return op.Wait()
+}
+
+// GetBaseImages returns fingerprints of images which instances are created from
+func (c *Client) GetBaseImages() (map[string]bool, error) {
+	instances, err := c.instServer.GetInstances(api.InstanceTypeAny)
+	if err != nil {
+		return nil, err
+	}
+	images := map[string]bool{}
+	for _, instance := range instances {
+		if fingerprint, ok := instance.Config[CONFIG_BASE_IMAGE]; ok && len(fingerprint) != 0 {
+			images[fingerprint] = true
+		}
+	}
+	return images, nil
+}
+
+// GetPoolUsage returns used and total space of storage pool in bytes
+func (c *Client) GetPoolUsage(name string) (uint64, uint64, error) {
+	resources, err := c.instServer.GetStoragePoolResources(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	return resources.Space.Used, resources.Space.Total, nil
+}
+
+// GetArchitecture returns the kernel architecture of lxd server, for instance x86_64 or aarch64
+func (c *Client) GetArchitecture() (string, error) {
+	server, _, err := c.instServer.GetServer()
+	if err != nil {
+		return "", err
+	}
+	return server.Environment.KernelArchitecture, nil
+}
+
 func (c *Client) CheckInstanceExists(name string, instanceType string) (bool, error) {
 	names, err := c.instServer.GetInstanceNames(api.InstanceType(instanceType))
 	if err != nil {
@@ -0,0 +1,215 @@
+package lxd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// the largest cpu id accepted in cpu set, which is the maximum cpus supported by linux kernel
+const MAX_CPU_ID = 8191
+
+// hugepageSizes maps supported hugepages size to lxd config key, page size is always binary
+var hugepageSizes = map[string]string{
+	"64K": "limits.hugepages.64KB",
+	"1M":  "limits.hugepages.1MB",
+	"2M":  "limits.hugepages.2MB",
+	"1G":  "limits.hugepages.1GB",
+}
+
+// parseQuantity parses kubernetes quantity, also accepts byte suffix (GB, GiB), bit suffix (Mbit, Gibit) and
+// upper case kilo (K, KiB) used in lxd style values.
+func parseQuantity(value, suffix string) (resource.Quantity, error) {
+	normalized := strings.TrimSpace(value)
+	if len(suffix) != 0 {
+		normalized = strings.TrimSuffix(normalized, suffix)
+	}
+	if strings.HasSuffix(normalized, "K") {
+		normalized = strings.TrimSuffix(normalized, "K") + "k"
+	}
+	if len(normalized) == 0 {
+		return resource.Quantity{}, errors.New("empty value")
+	}
+	quantity, err := resource.ParseQuantity(normalized)
+	if err != nil {
+		return resource.Quantity{}, err
+	}
+	if quantity.Sign() <= 0 {
+		return resource.Quantity{}, errors.New("value must be greater than 0")
+	}
+	return quantity, nil
+}
+
+// ParseCPULimit converts cpu quantity (2, 1.5, 500m) or allowance percentage (50%) into lxd limits.cpu and
+// limits.cpu.allowance, fractional cores are rounded up and throttled by allowance.
+func ParseCPULimit(value string) (string, string, error) {
+	if strings.HasSuffix(value, "%") {
+		if _, err := parsePercentage(value); err != nil {
+			return "", "", errors.New(fmt.Sprintf("invalid cpu limitation %s, %s", value, err))
+		}
+		return "1", value, nil
+	}
+	quantity, err := parseQuantity(value, "")
+	if err != nil {
+		return "", "", errors.New(fmt.Sprintf(
+			"invalid cpu limitation %s, only support cores (2, 0.5), millicores (500m) or percentage (50%%), %s",
+			value, err))
+	}
+	milliCPU := quantity.MilliValue()
+	cores := (milliCPU + 999) / 1000
+	if milliCPU%1000 == 0 {
+		return fmt.Sprintf("%d", cores), "", nil
+	}
+	return fmt.Sprintf("%d", cores), fmt.Sprintf("%d%%", (milliCPU*100+cores*500)/(cores*1000)), nil
+}
+
+// ParseMemoryLimit converts memory quantity (512Mi, 2G, 1GiB) or percentage (50%) into lxd limits.memory.
+func ParseMemoryLimit(value string) (string, error) {
+	if strings.HasSuffix(value, "%") {
+		if _, err := parsePercentage(value); err != nil {
+			return "", errors.New(fmt.Sprintf("invalid memory limitation %s, %s", value, err))
+		}
+		return value, nil
+	}
+	bytes, err := ParseByteSize(value)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("invalid memory limitation %s, %s", value, err))
+	}
+	return fmt.Sprintf("%dB", bytes), nil
+}
+
+// ParseDiskSize converts disk quantity (10Gi, 10G, 10GiB) into lxd disk size.
+func ParseDiskSize(value string) (string, error) {
+	bytes, err := ParseByteSize(value)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("invalid disk size %s, %s", value, err))
+	}
+	return fmt.Sprintf("%dB", bytes), nil
+}
+
+// ParseBandwidthLimit converts bandwidth quantity (100M, 100Mbit, 1Gibit) into lxd limits.ingress/limits.egress
+// which is in bit/s.
+func ParseBandwidthLimit(value string) (string, error) {
+	quantity, err := parseQuantity(value, "bit")
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("invalid network bandwidth %s, %s", value, err))
+	}
+	bits, err := wholeValue(quantity)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("invalid network bandwidth %s, %s", value, err))
+	}
+	return fmt.Sprintf("%dbit", bits), nil
+}
+
+// ParseByteSize converts quantity (512Mi, 2G, 1GiB, 1024) into bytes.
+func ParseByteSize(value string) (int64, error) {
+	normalized := strings.TrimSpace(value)
+	if len(normalized) > 1 && strings.HasSuffix(normalized, "B") {
+		normalized = strings.TrimSuffix(normalized, "B")
+	}
+	quantity, err := parseQuantity(normalized, "")
+	if err != nil {
+		return 0, err
+	}
+	return wholeValue(quantity)
+}
+
+// wholeValue returns value of quantity which must be a whole number, since Value rounds fractions (500m) up
+func wholeValue(quantity resource.Quantity) (int64, error) {
+	if quantity.MilliValue()%1000 != 0 {
+		return 0, errors.New(fmt.Sprintf("%s is not a whole number", quantity.String()))
+	}
+	return quantity.Value(), nil
+}
+
+func parsePercentage(value string) (int64, error) {
+	quantity, err := parseQuantity(strings.TrimSuffix(value, "%"), "")
+	if err != nil {
+		return 0, err
+	}
+	if quantity.MilliValue()%1000 != 0 || quantity.Value() > 100 {
+		return 0, errors.New("percentage must be an integer between 1 and 100")
+	}
+	return quantity.Value(), nil
+}
+
+// ParseDiskIOLimit converts disk io limitation in iops (100iops) or bytes/s quantity (10Mi, 10MB) into lxd
+// limits.read/limits.write.
+func ParseDiskIOLimit(value string) (string, error) {
+	if strings.HasSuffix(value, "iops") {
+		iops, err := strconv.ParseInt(strings.TrimSuffix(value, "iops"), 10, 64)
+		if err != nil || iops <= 0 {
+			return "", errors.New(fmt.Sprintf("invalid disk iops %s, must be a positive integer", value))
+		}
+		return fmt.Sprintf("%diops", iops), nil
+	}
+	bytes, err := ParseByteSize(value)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf(
+			"invalid disk io limitation %s, only support iops (100iops) or bytes/s (10Mi, 10MB), %s", value, err))
+	}
+	return fmt.Sprintf("%dB", bytes), nil
+}
+
+// ParseHugepagesLimit converts hugepages limitation in the format of <page-size>=<limit>, for instance 2MB=1Gi,
+// into lxd config key and value.
+func ParseHugepagesLimit(value string) (string, string, error) {
+	arr := strings.SplitN(value, "=", 2)
+	if len(arr) != 2 {
+		return "", "", errors.New(fmt.Sprintf("invalid hugepages limitation %s, in the format of <page-size>=<limit>", value))
+	}
+	pageSize := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(arr[0]), "B"), "I")
+	key, ok := hugepageSizes[pageSize]
+	if !ok {
+		return "", "", errors.New(fmt.Sprintf("unsupported hugepages size %s, only support 64KB, 1MB, 2MB or 1GB", arr[0]))
+	}
+	limit, err := ParseByteSize(arr[1])
+	if err != nil {
+		return "", "", errors.New(fmt.Sprintf("invalid hugepages limit %s, %s", arr[1], err))
+	}
+	return key, fmt.Sprintf("%dB", limit), nil
+}
+
+// ParseCPUSet validates cpu set (0-3,5) used for cpu pinning and returns the number of cpus as well as the
+// normalized cpu set. Single cpu is normalized as range (3-3) since lxd regards a single number as cpu count.
+func ParseCPUSet(value string) (int, string, error) {
+	cpus := map[int64]bool{}
+	for _, part := range strings.Split(value, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		start, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil || start < 0 || start > MAX_CPU_ID {
+			return 0, "", errors.New(fmt.Sprintf("invalid cpu set %s, in the format of 0-3,5 with cpus up to %d",
+				value, MAX_CPU_ID))
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.ParseInt(bounds[1], 10, 64)
+			if err != nil || end < start || end > MAX_CPU_ID {
+				return 0, "", errors.New(fmt.Sprintf("invalid cpu range %s in cpu set %s", part, value))
+			}
+		}
+		for i := start; i <= end; i++ {
+			cpus[i] = true
+		}
+	}
+	var ranges []string
+	for start := int64(0); start <= MAX_CPU_ID; start++ {
+		if !cpus[start] {
+			continue
+		}
+		end := start
+		for end+1 <= MAX_CPU_ID && cpus[end+1] {
+			end++
+		}
+		if end == start && len(cpus) > 1 {
+			ranges = append(ranges, strconv.FormatInt(start, 10))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, end))
+		}
+		start = end
+	}
+	return len(cpus), strings.Join(ranges, ","), nil
+}
@@ -0,0 +1,270 @@
+package lxd
+
+import (
+	"testing"
+)
+
+func TestParseCPULimit(t *testing.T) {
+	cases := []struct {
+		value     string
+		cpu       string
+		allowance string
+		valid     bool
+	}{
+		{value: "2", cpu: "2", valid: true},
+		{value: "1.5", cpu: "2", allowance: "75%", valid: true},
+		{value: "500m", cpu: "1", allowance: "50%", valid: true},
+		{value: "2500m", cpu: "3", allowance: "83%", valid: true},
+		{value: "50%", cpu: "1", allowance: "50%", valid: true},
+		{value: "100%", cpu: "1", allowance: "100%", valid: true},
+		{value: "", valid: false},
+		{value: "0", valid: false},
+		{value: "-1", valid: false},
+		{value: "two", valid: false},
+		{value: "0%", valid: false},
+		{value: "150%", valid: false},
+		{value: "2.5%", valid: false},
+	}
+	for _, c := range cases {
+		cpu, allowance, err := ParseCPULimit(c.value)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("cpu limitation %q: expected error got %s %s", c.value, cpu, allowance)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cpu limitation %q: unexpected error %s", c.value, err)
+			continue
+		}
+		if cpu != c.cpu || allowance != c.allowance {
+			t.Errorf("cpu limitation %q: expected %q %q got %q %q", c.value, c.cpu, c.allowance, cpu, allowance)
+		}
+	}
+}
+
+func TestParseMemoryLimit(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+		valid    bool
+	}{
+		{value: "512Mi", expected: "536870912B", valid: true},
+		{value: "2G", expected: "2000000000B", valid: true},
+		{value: "1GiB", expected: "1073741824B", valid: true},
+		{value: "1GB", expected: "1000000000B", valid: true},
+		{value: "1K", expected: "1000B", valid: true},
+		{value: "1KB", expected: "1000B", valid: true},
+		{value: "1KiB", expected: "1024B", valid: true},
+		{value: "1.5Ki", expected: "1536B", valid: true},
+		{value: "1024", expected: "1024B", valid: true},
+		{value: " 1Mi ", expected: "1048576B", valid: true},
+		{value: "50%", expected: "50%", valid: true},
+		// fractional bytes are rounded up by quantity
+		{value: "500m", valid: false},
+		{value: "0.5", valid: false},
+		{value: "", valid: false},
+		{value: "B", valid: false},
+		{value: "0", valid: false},
+		{value: "-1Gi", valid: false},
+		{value: "1TB!", valid: false},
+		{value: "101%", valid: false},
+	}
+	for _, c := range cases {
+		limit, err := ParseMemoryLimit(c.value)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("memory limitation %q: expected error got %s", c.value, limit)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("memory limitation %q: unexpected error %s", c.value, err)
+			continue
+		}
+		if limit != c.expected {
+			t.Errorf("memory limitation %q: expected %q got %q", c.value, c.expected, limit)
+		}
+	}
+}
+
+func TestParseDiskSize(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+		valid    bool
+	}{
+		{value: "10Gi", expected: "10737418240B", valid: true},
+		{value: "10GiB", expected: "10737418240B", valid: true},
+		{value: "10G", expected: "10000000000B", valid: true},
+		{value: "10GB", expected: "10000000000B", valid: true},
+		{value: "1500m", valid: false},
+		{value: "ten", valid: false},
+	}
+	for _, c := range cases {
+		size, err := ParseDiskSize(c.value)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("disk size %q: expected error got %s", c.value, size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("disk size %q: unexpected error %s", c.value, err)
+			continue
+		}
+		if size != c.expected {
+			t.Errorf("disk size %q: expected %q got %q", c.value, c.expected, size)
+		}
+	}
+}
+
+func TestParseBandwidthLimit(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+		valid    bool
+	}{
+		{value: "100M", expected: "100000000bit", valid: true},
+		{value: "100Mbit", expected: "100000000bit", valid: true},
+		{value: "1Gibit", expected: "1073741824bit", valid: true},
+		{value: "1kbit", expected: "1000bit", valid: true},
+		{value: "1Kbit", expected: "1000bit", valid: true},
+		{value: "1000", expected: "1000bit", valid: true},
+		// fractional bits are rounded up by quantity
+		{value: "100m", valid: false},
+		{value: "100mbit", valid: false},
+		{value: "bit", valid: false},
+		{value: "0bit", valid: false},
+		{value: "fast", valid: false},
+	}
+	for _, c := range cases {
+		limit, err := ParseBandwidthLimit(c.value)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("bandwidth %q: expected error got %s", c.value, limit)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("bandwidth %q: unexpected error %s", c.value, err)
+			continue
+		}
+		if limit != c.expected {
+			t.Errorf("bandwidth %q: expected %q got %q", c.value, c.expected, limit)
+		}
+	}
+}
+
+func TestParseCPUSet(t *testing.T) {
+	cases := []struct {
+		value    string
+		cpus     int
+		expected string
+		valid    bool
+	}{
+		// single cpu is written as range since lxd regards a number as cpu count
+		{value: "3", cpus: 1, expected: "3-3", valid: true},
+		{value: "0", cpus: 1, expected: "0-0", valid: true},
+		{value: "1,3", cpus: 2, expected: "1,3", valid: true},
+		{value: "0-3,5", cpus: 5, expected: "0-3,5", valid: true},
+		{value: "3,2,1", cpus: 3, expected: "1-3", valid: true},
+		{value: "0-3,2-5,7", cpus: 7, expected: "0-5,7", valid: true},
+		{value: "4-4", cpus: 1, expected: "4-4", valid: true},
+		{value: "8191", cpus: 1, expected: "8191-8191", valid: true},
+		{value: "0-8191", cpus: 8192, expected: "0-8191", valid: true},
+		{value: "8192", valid: false},
+		{value: "0-99999999", valid: false},
+		{value: "5-3", valid: false},
+		{value: "-1", valid: false},
+		{value: "1,,2", valid: false},
+		{value: "", valid: false},
+		{value: "a", valid: false},
+	}
+	for _, c := range cases {
+		cpus, cpuSet, err := ParseCPUSet(c.value)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("cpu set %q: expected error got %d %s", c.value, cpus, cpuSet)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cpu set %q: unexpected error %s", c.value, err)
+			continue
+		}
+		if cpus != c.cpus || cpuSet != c.expected {
+			t.Errorf("cpu set %q: expected %d %q got %d %q", c.value, c.cpus, c.expected, cpus, cpuSet)
+		}
+	}
+}
+
+func TestParseDiskIOLimit(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected string
+		valid    bool
+	}{
+		{value: "100iops", expected: "100iops", valid: true},
+		{value: "10Mi", expected: "10485760B", valid: true},
+		{value: "10MB", expected: "10000000B", valid: true},
+		{value: "10M", expected: "10000000B", valid: true},
+		{value: "0iops", valid: false},
+		{value: "-5iops", valid: false},
+		{value: "1.5iops", valid: false},
+		{value: "iops", valid: false},
+		{value: "500m", valid: false},
+		{value: "fast", valid: false},
+	}
+	for _, c := range cases {
+		limit, err := ParseDiskIOLimit(c.value)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("disk io limitation %q: expected error got %s", c.value, limit)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("disk io limitation %q: unexpected error %s", c.value, err)
+			continue
+		}
+		if limit != c.expected {
+			t.Errorf("disk io limitation %q: expected %q got %q", c.value, c.expected, limit)
+		}
+	}
+}
+
+func TestParseHugepagesLimit(t *testing.T) {
+	cases := []struct {
+		value    string
+		key      string
+		expected string
+		valid    bool
+	}{
+		{value: "2MB=1Gi", key: "limits.hugepages.2MB", expected: "1073741824B", valid: true},
+		{value: "1GiB=2Gi", key: "limits.hugepages.1GB", expected: "2147483648B", valid: true},
+		{value: "64k=1Mi", key: "limits.hugepages.64KB", expected: "1048576B", valid: true},
+		{value: "1M=512MB", key: "limits.hugepages.1MB", expected: "512000000B", valid: true},
+		{value: "4MB=1Gi", valid: false},
+		{value: "2MB", valid: false},
+		{value: "2MB=", valid: false},
+		{value: "2MB=500m", valid: false},
+		{value: "=1Gi", valid: false},
+	}
+	for _, c := range cases {
+		key, limit, err := ParseHugepagesLimit(c.value)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("hugepages limitation %q: expected error got %s %s", c.value, key, limit)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("hugepages limitation %q: unexpected error %s", c.value, err)
+			continue
+		}
+		if key != c.key || limit != c.expected {
+			t.Errorf("hugepages limitation %q: expected %q %q got %q %q", c.value, c.key, c.expected, key, limit)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package lxd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"lxc-launcher/util"
+)
+
+const (
+	RESOURCE_SOURCE_DOWNWARD   = "downward-api"
+	RESOURCE_SOURCE_KUBERNETES = "kubernetes"
+	// downward api files, cpu_limit should be exposed with divisor 1m and memory_limit with divisor 1
+	DOWNWARD_CPU_LIMIT    = "cpu_limit"
+	DOWNWARD_MEMORY_LIMIT = "memory_limit"
+)
+
+// PodResource is the resource limit of the launcher container, cpu in millicores and memory in bytes
+type PodResource struct {
+	MilliCPU int64
+	Memory   int64
+}
+
+// LoadPodResourceFromDownwardAPI reads container limits from the files projected by downward api volume
+func LoadPodResourceFromDownwardAPI(folder string) (*PodResource, error) {
+	res := &PodResource{}
+	cpu, err := readDownwardValue(filepath.Join(folder, DOWNWARD_CPU_LIMIT))
+	if err != nil {
+		return nil, err
+	}
+	res.MilliCPU = cpu
+	memory, err := readDownwardValue(filepath.Join(folder, DOWNWARD_MEMORY_LIMIT))
+	if err != nil {
+		return nil, err
+	}
+	res.Memory = memory
+	return res, nil
+}
+
+func readDownwardValue(filePath string) (int64, error) {
+	if !FileExists(filePath) {
+		return 0, errors.New(fmt.Sprintf("downward api file %s not found, limits.cpu and limits.memory of "+
+			"launcher container should be projected into downward api volume", filePath))
+	}
+	content, err := util.ReadContent(filePath)
+	if err != nil {
+		return 0, err
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(content), 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid downward api value %s in file %s", content, filePath))
+	}
+	return value, nil
+}
+
+// LoadPodResourceFromKubernetes reads container limits from the pod spec, requests are used when limits not set
+func LoadPodResourceFromKubernetes(namespace, podName, containerName string) (*PodResource, error) {
+	if len(namespace) == 0 || len(podName) == 0 {
+		return nil, errors.New("pod name and namespace are required when reading resource from kubernetes")
+	}
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		if config, err = GetResConfig("conf"); err != nil {
+			return nil, err
+		}
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	pod, err := clientset.CoreV1().Pods(namespace).Get(context.TODO(), podName, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var container *corev1.Container
+	for i := range pod.Spec.Containers {
+		if len(containerName) == 0 || pod.Spec.Containers[i].Name == containerName {
+			container = &pod.Spec.Containers[i]
+			break
+		}
+	}
+	if container == nil {
+		return nil, errors.New(fmt.Sprintf("container %s not found in pod %s/%s", containerName, namespace, podName))
+	}
+	res := &PodResource{}
+	if cpu := containerQuantity(container, corev1.ResourceCPU); cpu != nil {
+		res.MilliCPU = cpu.MilliValue()
+	}
+	if memory := containerQuantity(container, corev1.ResourceMemory); memory != nil {
+		res.Memory = memory.Value()
+	}
+	return res, nil
+}
+
+func containerQuantity(container *corev1.Container, name corev1.ResourceName) *resource.Quantity {
+	if q, ok := container.Resources.Limits[name]; ok && !q.IsZero() {
+		return &q
+	}
+	if q, ok := container.Resources.Requests[name]; ok && !q.IsZero() {
+		return &q
+	}
+	return nil
+}
+
+// CPUResource returns the cpu millicores with overcommit ratio applied, empty when cpu limit not set
+func (r *PodResource) CPUResource(overcommit float64) string {
+	if r.MilliCPU <= 0 {
+		return ""
+	}
+	milliCPU := int64(float64(r.MilliCPU) * overcommit)
+	if milliCPU <= 0 {
+		milliCPU = 1
+	}
+	return fmt.Sprintf("%dm", milliCPU)
+}
+
+// MemoryResource returns the memory in Mi with overcommit ratio applied, empty when memory limit not set
+func (r *PodResource) MemoryResource(overcommit float64) string {
+	if r.Memory <= 0 {
+		return ""
+	}
+	mebibytes := int64(float64(r.Memory)*overcommit) / (1 << 20)
+	if mebibytes <= 0 {
+		mebibytes = 1
+	}
+	return fmt.Sprintf("%dMi", mebibytes)
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -30,6 +31,69 @@ func MergeDeviceConfigs(instDevices, newDevices map[string]map[string]string) ma
 	return instDevices
 }
 
+// DiffConfigs returns the changes from old config to new config, one line per key in the format of
+// "+ key: value", "- key: value" or "~ key: old -> new"
+func DiffConfigs(prefix string, oldConfig, newConfig map[string]string) []string {
+	var diff []string
+	keys := map[string]bool{}
+	for k := range oldConfig {
+		keys[k] = true
+	}
+	for k := range newConfig {
+		keys[k] = true
+	}
+	sortedKeys := make([]string, 0, len(keys))
+	for k := range keys {
+		sortedKeys = append(sortedKeys, k)
+	}
+	sort.Strings(sortedKeys)
+	for _, k := range sortedKeys {
+		oldValue, oldOk := oldConfig[k]
+		newValue, newOk := newConfig[k]
+		switch {
+		case !oldOk:
+			diff = append(diff, fmt.Sprintf("+ %s%s: %s", prefix, k, newValue))
+		case !newOk:
+			diff = append(diff, fmt.Sprintf("- %s%s: %s", prefix, k, oldValue))
+		case oldValue != newValue:
+			diff = append(diff, fmt.Sprintf("~ %s%s: %s -> %s", prefix, k, oldValue, newValue))
+		}
+	}
+	return diff
+}
+
+// DiffDeviceConfigs returns the changes from old devices to new devices, devices are flattened into configs
+// keyed by <device>.<key> and compared with DiffConfigs
+func DiffDeviceConfigs(oldDevices, newDevices map[string]map[string]string) []string {
+	return DiffConfigs("devices.", flattenDeviceConfigs(oldDevices), flattenDeviceConfigs(newDevices))
+}
+
+func flattenDeviceConfigs(devices map[string]map[string]string) map[string]string {
+	flattened := map[string]string{}
+	for name, config := range devices {
+		for k, v := range config {
+			flattened[fmt.Sprintf("%s.%s", name, k)] = v
+		}
+	}
+	return flattened
+}
+
+func CopyConfigs(config map[string]string) map[string]string {
+	configCopy := make(map[string]string, len(config))
+	for k, v := range config {
+		configCopy[k] = v
+	}
+	return configCopy
+}
+
+func CopyDeviceConfigs(devices map[string]map[string]string) map[string]map[string]string {
+	devicesCopy := make(map[string]map[string]string, len(devices))
+	for k, v := range devices {
+		devicesCopy[k] = CopyConfigs(v)
+	}
+	return devicesCopy
+}
+
 func CmdForLog(command string, args ...string) string {
 	if strings.ContainsAny(command, " \t\n") {
 		command = fmt.Sprintf("%q", command)
@@ -47,6 +111,9 @@ func CmdForLog(command string, args ...string) string {
 type cleanUp func()
 type statusHandler func(w http.ResponseWriter, req *http.Request)
 
+// StatusHandlers maps request path to handler served by status server
+type StatusHandlers map[string]statusHandler
+
 // ListenSignals Graceful start/stop server
 func ListenSignals(cleanup cleanUp) {
 	sigChan := make(chan os.Signal, 1)
@@ -74,8 +141,15 @@ func handleSignals(c chan os.Signal, cleanup cleanUp) {
 }
 
 func ServerHealth(handler statusHandler, statusPort int64) {
+	ServerStatus(StatusHandlers{"/healthz": handler}, statusPort)
+}
+
+// ServerStatus serves health and other status handlers on status port
+func ServerStatus(handlers StatusHandlers, statusPort int64) {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", handler)
+	for pattern, handler := range handlers {
+		mux.HandleFunc(pattern, handler)
+	}
 	statusServer := http.Server{
 		Addr:           fmt.Sprintf("0.0.0.0:%d", statusPort),
 		Handler:        mux,